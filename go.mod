@@ -4,11 +4,14 @@ go 1.23.1
 
 require (
 	github.com/joho/godotenv v1.5.1
+	github.com/klauspost/compress v1.17.11
 	github.com/mattn/go-sqlite3 v1.14.23
 	github.com/sevlyar/go-daemon v0.1.6
+	golang.org/x/crypto v0.28.0
+	golang.org/x/term v0.25.0
 )
 
 require (
 	github.com/kardianos/osext v0.0.0-20190222173326-2bc1f35cddc0 // indirect
-	golang.org/x/sys v0.25.0 // indirect
+	golang.org/x/sys v0.26.0 // indirect
 )
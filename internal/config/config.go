@@ -1,6 +1,7 @@
 package config
 
 import (
+	"fenfa/pkg/utils"
 	"log"
 	"os"
 	"path/filepath"
@@ -21,6 +22,17 @@ const (
 	EnvMaxZipDepth             = "FENFA_MAX_ZIP_DEPTH"
 	EnvTemplateIncludesPort    = "FENFA_TEMPLATE_INCLUDES_PORT"
 	EnvRateLimit               = "FENFA_RATE_LIMIT"
+	EnvJanitorInterval         = "FENFA_JANITOR_INTERVAL"
+	EnvMaxUploadSize           = "FENFA_MAX_UPLOAD_SIZE"
+	EnvMaxUploadRequestSize    = "FENFA_MAX_UPLOAD_REQUEST_SIZE"
+	EnvMaxUploadFiles          = "FENFA_MAX_UPLOAD_FILES"
+	EnvSymlinkPolicy           = "FENFA_SYMLINK_POLICY"
+	EnvCompressionWorkers      = "FENFA_COMPRESSION_WORKERS"
+	EnvEncryptAtRest           = "FENFA_ENCRYPT_AT_REST"
+	EnvArchiveKeyFile          = "FENFA_ARCHIVE_KEY_FILE"
+	EnvLandingPage             = "FENFA_LANDING_PAGE"
+	EnvMaxChecksumSize         = "FENFA_MAX_CHECKSUM_SIZE"
+	EnvTemplateDir             = "FENFA_TEMPLATE_DIR"
 )
 
 // Default values
@@ -31,6 +43,15 @@ const (
 	DefaultMaxZipDepth        = 2
 	DefaultFailedAttemptLimit = 5
 	DefaultRateLimit          = 30
+	DefaultJanitorInterval    = 3600       // 1 hour
+	DefaultMaxUploadSize      = 1073741824 // 1 GB
+	DefaultMaxUploadRequest   = 4294967296 // 4 GB
+	DefaultMaxUploadFiles     = 100
+	DefaultSymlinkPolicy      = "" // Depends on the archive format, see utils.DefaultSymlinkPolicy
+	DefaultCompressionWorkers = 0  // One per CPU
+	DefaultArchiveKeyFile     = "archive.key"
+	DefaultCookieKeyFile      = "cookie.key"
+	DefaultMaxChecksumSize    = 4294967296 // 4 GB
 )
 
 // Global configuration variables
@@ -47,6 +68,18 @@ var (
 	TemplateIncludesPort bool
 	BinaryDirectory      string
 	RateLimit            int
+	JanitorInterval      int64
+	MaxUploadSize        int64
+	MaxUploadRequestSize int64
+	MaxUploadFiles       int
+	SymlinkPolicy        string
+	CompressionWorkers   int
+	EncryptAtRest        bool
+	ArchiveKeyFile       string
+	CookieKeyFile        string
+	LandingPage          bool
+	MaxChecksumSize      int64
+	TemplateDir          string
 )
 
 // Initialize loads configuration from the environment
@@ -65,11 +98,46 @@ func Initialize(dir string) {
 	MaxZipDepth = getEnvAsInt(EnvMaxZipDepth, DefaultMaxZipDepth)
 	MaxZipSize = getEnvAsInt64(EnvMaxZipSize, DefaultMaxZipSize)
 	RateLimit = getEnvAsInt(EnvRateLimit, DefaultRateLimit)
+	JanitorInterval = getEnvAsInt64(EnvJanitorInterval, DefaultJanitorInterval)
+	MaxUploadSize = getEnvAsInt64(EnvMaxUploadSize, DefaultMaxUploadSize)
+	MaxUploadRequestSize = getEnvAsInt64(EnvMaxUploadRequestSize, DefaultMaxUploadRequest)
+	MaxUploadFiles = getEnvAsInt(EnvMaxUploadFiles, DefaultMaxUploadFiles)
+	SymlinkPolicy = getEnvAsString(EnvSymlinkPolicy, DefaultSymlinkPolicy)
+	if SymlinkPolicy != "" && !utils.ValidSymlinkPolicy(SymlinkPolicy) {
+		log.Fatalf("Invalid value for %s: %s", EnvSymlinkPolicy, SymlinkPolicy)
+	}
+	CompressionWorkers = getEnvAsInt(EnvCompressionWorkers, DefaultCompressionWorkers)
 	TemplateIncludesPort = getEnvAsBool(EnvTemplateIncludesPort, true)
+	LandingPage = getEnvAsBool(EnvLandingPage, false)
+	MaxChecksumSize = getEnvAsInt64(EnvMaxChecksumSize, DefaultMaxChecksumSize)
+	TemplateDir = os.Getenv(EnvTemplateDir)
+	if TemplateDir != "" && !filepath.IsAbs(TemplateDir) {
+		TemplateDir = filepath.Join(BinaryDirectory, TemplateDir)
+	}
 
 	// DataFile and ZipDirectory require additional setup
 	DataFile = os.Getenv(EnvDataFile)
 	ZipDirectory = filepath.Join(BinaryDirectory, ".fenfa")
+
+	// The key must not live next to the archives it protects.
+	EncryptAtRest = getEnvAsBool(EnvEncryptAtRest, true)
+	ArchiveKeyFile = getEnvAsString(EnvArchiveKeyFile, DefaultArchiveKeyFile)
+	if !filepath.IsAbs(ArchiveKeyFile) {
+		ArchiveKeyFile = filepath.Join(BinaryDirectory, ArchiveKeyFile)
+	}
+	if utils.IsWithin(ZipDirectory, ArchiveKeyFile) {
+		log.Fatalf("Invalid value for %s: the key file cannot be inside %s", EnvArchiveKeyFile, ZipDirectory)
+	}
+	CookieKeyFile = filepath.Join(filepath.Dir(ArchiveKeyFile), DefaultCookieKeyFile)
+}
+
+// Helper to get environment variables as a string with a default value
+func getEnvAsString(key string, defaultVal string) string {
+	valStr := os.Getenv(key)
+	if valStr == "" {
+		return defaultVal
+	}
+	return valStr
 }
 
 // Helper to get environment variables as an integer with a default value
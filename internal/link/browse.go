@@ -0,0 +1,189 @@
+package link
+
+import (
+	"fenfa/internal/store"
+	"fenfa/pkg/utils"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type browseItem struct {
+	Name     string
+	Href     string
+	IsDir    bool
+	Size     string
+	Modified string
+}
+
+type browsePage struct {
+	Title     string
+	Path      string
+	Parent    bool
+	Items     []browseItem
+	Truncated bool
+	Format    string
+}
+
+// serveBrowse serves the index, files and on-demand zips of a browsable
+// directory link. rest is the path below the link, e.g. "sub/file.txt".
+func serveBrowse(w http.ResponseWriter, r *http.Request, entry store.Entry, rest string) {
+	segments, ok := browseSegments(rest)
+	if !ok {
+		ServeError(w, r, http.StatusNotFound, "404 page not found")
+		return
+	}
+	depth := len(segments)
+	archive := entryArchiveOptions(entry)
+	if archive.MaxDepth >= 0 && depth > archive.MaxDepth+1 {
+		ServeError(w, r, http.StatusNotFound, "404 page not found")
+		return
+	}
+
+	fullPath := filepath.Join(append([]string{entry.Path}, segments...)...)
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		log.Printf("Browse path not found for hash %s: %s", entry.Hash, fullPath)
+		ServeError(w, r, http.StatusNotFound, "404 page not found")
+		return
+	}
+	// Files of the deepest shared folder are one level below it, but the
+	// folders next to them are not shared.
+	if archive.MaxDepth >= 0 && depth > archive.MaxDepth && info.IsDir() {
+		ServeError(w, r, http.StatusNotFound, "404 page not found")
+		return
+	}
+
+	if len(segments) > 0 && !browsable(entry, archive, strings.Join(segments, "/"), info) {
+		ServeError(w, r, http.StatusNotFound, "404 page not found")
+		return
+	}
+
+	if !info.IsDir() {
+		serveBrowseFile(w, r, entry, fullPath, info)
+		return
+	}
+
+	// Relative links in the index only resolve below a trailing slash.
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	if _, ok := r.URL.Query()["zip"]; ok {
+		serveArchive(w, r, entry, fullPath, depth)
+		return
+	}
+
+	serveIndex(w, r, entry, archive, fullPath, segments)
+}
+
+// browseSegments splits the path below a link into its segments, rejecting
+// anything that could escape the shared directory.
+func browseSegments(rest string) ([]string, bool) {
+	var segments []string
+	for _, segment := range strings.Split(rest, "/") {
+		switch segment {
+		case "":
+			continue
+		case ".", "..":
+			return nil, false
+		}
+		if strings.ContainsRune(segment, filepath.Separator) {
+			return nil, false
+		}
+		segments = append(segments, segment)
+	}
+	return segments, true
+}
+
+// browsable reports whether rel may be listed and served under the link's
+// filters and symlink policy.
+func browsable(entry store.Entry, archive utils.ArchiveOptions, rel string, info os.FileInfo) bool {
+	allowed, err := utils.PathAllowed(entry.Path, rel, archive)
+	if err != nil || !allowed {
+		return false
+	}
+	excluded, err := utils.PathExcluded(entry.Path, rel, info.IsDir(), archive)
+	if err != nil {
+		log.Printf("Error applying filters for hash %s: %v", entry.Hash, err)
+		return false
+	}
+	return !excluded
+}
+
+func serveIndex(w http.ResponseWriter, r *http.Request, entry store.Entry, archive utils.ArchiveOptions, fullPath string, segments []string) {
+	files, err := os.ReadDir(fullPath)
+	if err != nil {
+		log.Printf("Error reading directory %s: %v", fullPath, err)
+		ServeError(w, r, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	page := browsePage{
+		Title:  filepath.Base(entry.Path),
+		Path:   "/" + strings.Join(segments, "/"),
+		Parent: len(segments) > 0,
+		Format: archive.Format,
+	}
+	deepest := archive.MaxDepth >= 0 && len(segments) >= archive.MaxDepth
+
+	for _, file := range files {
+		info, err := os.Stat(filepath.Join(fullPath, file.Name()))
+		if err != nil {
+			continue
+		}
+		rel := strings.Join(append(segments[:len(segments):len(segments)], file.Name()), "/")
+		if !browsable(entry, archive, rel, info) {
+			continue
+		}
+		if deepest && info.IsDir() {
+			page.Truncated = true
+			continue
+		}
+		item := browseItem{
+			Name:     file.Name(),
+			Href:     url.PathEscape(file.Name()),
+			IsDir:    info.IsDir(),
+			Modified: info.ModTime().Format("2006-01-02 15:04"),
+		}
+		if item.IsDir {
+			item.Href += "/"
+		} else {
+			item.Size = utils.FormatBytes(info.Size())
+		}
+		page.Items = append(page.Items, item)
+	}
+
+	log.Printf("Serving index: %s for hash: %s", fullPath, entry.Hash)
+	renderTemplate(w, http.StatusOK, "browse.html", page)
+}
+
+func serveBrowseFile(w http.ResponseWriter, r *http.Request, entry store.Entry, fullPath string, info os.FileInfo) {
+	file, err := os.Open(fullPath)
+	if err != nil {
+		log.Printf("Error opening file %s: %v", fullPath, err)
+		ServeError(w, r, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	defer file.Close()
+
+	if entry.MaxDownloads > 0 {
+		r.Header.Del("Range")
+	}
+
+	if !claimDownload(w, r, entry) {
+		return
+	}
+	w.Header().Set("Content-Disposition", utils.ContentDisposition("attachment", info.Name()))
+	log.Printf("Serving file: %s for hash: %s", fullPath, entry.Hash)
+	rec := &transferRecorder{ResponseWriter: w}
+	http.ServeContent(rec, r, info.Name(), info.ModTime(), file)
+
+	if !rec.completed(info.Size()) {
+		releaseDownload(entry)
+	}
+}
@@ -0,0 +1,94 @@
+package link
+
+import (
+	"fenfa/internal/config"
+	"fenfa/internal/store"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// setupArchives initializes a database and a zip directory in temporary
+// directories.
+func setupArchives(t *testing.T) {
+	t.Helper()
+	config.BinaryDirectory = t.TempDir()
+	config.ZipDirectory = t.TempDir()
+	store.Initialize()
+}
+
+func TestBrowseSegments(t *testing.T) {
+	tests := []struct {
+		raw  string // Escaped as in a request URL
+		want []string
+		ok   bool
+	}{
+		{"", nil, true},
+		{"sub/", []string{"sub"}, true},
+		{"sub//file.txt", []string{"sub", "file.txt"}, true},
+		{"a%20b/c.txt", []string{"a b", "c.txt"}, true},
+		{"..", nil, false},
+		{"sub/../..", nil, false},
+		{"./file.txt", nil, false},
+		{"%2E%2E/secret", nil, false},
+		{"sub%2F..%2F..%2Fsecret", nil, false},
+		{"..%2Fsecret", nil, false},
+	}
+	for _, tt := range tests {
+		rest, err := url.PathUnescape(tt.raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := browseSegments(rest)
+		if ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("browseSegments(%q) = %q, %v, want %q, %v", rest, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestServeBrowseStaysInside(t *testing.T) {
+	setupArchives(t)
+	root := t.TempDir()
+	shared := filepath.Join(root, "shared")
+	if err := os.MkdirAll(filepath.Join(shared, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"secret.txt": "secret", "shared/sub/file.txt": "shared"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config.MaxZipDepth = -1
+	entry := store.Entry{Hash: "link", Expiration: time.Now().Add(time.Hour).Unix(), Path: shared, Mode: store.ModeBrowse}
+	if err := store.Add(entry); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		raw  string
+		want int
+	}{
+		{"/link/sub/file.txt", http.StatusOK},
+		{"/link/sub%2Ffile.txt", http.StatusOK},
+		{"/link/..%2Fsecret.txt", http.StatusNotFound},
+		{"/link/sub%2F..%2F..%2Fsecret.txt", http.StatusNotFound},
+		{"/link/%2E%2E/secret.txt", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.raw, nil)
+		w := httptest.NewRecorder()
+		_, rest := splitLinkPath(r.URL.Path)
+		serveBrowse(w, r, entry, rest)
+		if w.Code != tt.want {
+			t.Errorf("GET %s = %d, want %d", tt.raw, w.Code, tt.want)
+		}
+		if w.Body.String() == "secret" {
+			t.Errorf("GET %s served a file outside the shared directory", tt.raw)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package link
+
+import (
+	"fenfa/internal/config"
+	"fenfa/pkg/utils"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// dryRun prints what a link for path would share without creating an
+// archive or storing the link. archive is nil for single files.
+func dryRun(path string, info os.FileInfo, archive *utils.ArchiveOptions, opts Options) {
+	expiration := time.Unix(opts.expiration(time.Now()), 0)
+	fmt.Printf("Dry run, no link created: %s\n", path)
+
+	if archive == nil {
+		fmt.Println("Type:       file")
+		fmt.Printf("Size:       %s\n", utils.FormatBytes(info.Size()))
+		fmt.Printf("Expires:    %s\n", expiration.Format(time.RFC3339))
+		return
+	}
+
+	kind := archive.Format + " archive"
+	switch {
+	case opts.Browse:
+		kind = "browsable directory"
+	case opts.Live:
+		kind = "live " + kind
+	}
+	fmt.Printf("Type:       %s\n", kind)
+	if opts.EncryptArchive {
+		fmt.Println("Encrypted:  yes, the passphrase is set when the link is created")
+	}
+	fmt.Printf("Expires:    %s\n", expiration.Format(time.RFC3339))
+	fmt.Println()
+
+	summary, err := utils.ListArchive(path, *archive, func(entry utils.WalkEntry) {
+		switch {
+		case entry.Info.IsDir():
+			fmt.Printf("  %s/\n", entry.RelPath)
+		case entry.LinkTarget != "":
+			fmt.Printf("  %s -> %s\n", entry.RelPath, entry.LinkTarget)
+		default:
+			fmt.Printf("  %s (%s)\n", entry.RelPath, utils.FormatBytes(entry.Info.Size()))
+		}
+	})
+	if err != nil {
+		log.Printf("Error checking file information: %s", path)
+		fmt.Printf("Error scanning directory: %v\n", err)
+		return
+	}
+	fmt.Println()
+
+	fmt.Printf("Files:      %d\n", summary.Files)
+	fmt.Printf("Total size: %s\n", utils.FormatBytes(summary.Size))
+	if archive.MaxDepth < 0 {
+		fmt.Println("Depth:      unlimited")
+	} else {
+		fmt.Printf("Depth:      %d\n", archive.MaxDepth)
+	}
+	if len(summary.Truncated) > 0 {
+		fmt.Printf("Truncated:  %d file(s) below the depth limit\n", summary.OmittedFiles())
+		for _, truncated := range summary.Truncated {
+			fmt.Printf("  %s (%d file(s))\n", truncatedName(truncated), truncated.Files)
+		}
+	}
+	if len(summary.Skipped) > 0 {
+		fmt.Printf("Skipped:    %d\n", len(summary.Skipped))
+		for _, skipped := range summary.Skipped {
+			fmt.Printf("  %s: %s\n", skipped.RelPath, skipped.Reason)
+		}
+	}
+
+	if !opts.Browse {
+		if summary.Size > config.MaxZipSize {
+			fmt.Printf("Size limit: exceeded, %s is over the limit of %s\n",
+				utils.FormatBytes(summary.Size), utils.FormatBytes(config.MaxZipSize))
+		} else {
+			fmt.Printf("Size limit: ok (%s)\n", utils.FormatBytes(config.MaxZipSize))
+		}
+	}
+	if opts.Strict && (len(summary.Skipped) > 0 || len(summary.Truncated) > 0) {
+		fmt.Println("Strict:     the link would be refused because some files would be left out")
+	}
+}
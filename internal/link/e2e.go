@@ -0,0 +1,112 @@
+package link
+
+import (
+	"bufio"
+	"fenfa/internal/config"
+	"fenfa/internal/store"
+	"fenfa/pkg/utils"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// e2eExtension marks end-to-end encrypted files in the zip directory.
+const e2eExtension = ".e2e"
+
+// createE2EFile encrypts the file at path, or an archive of the directory
+// when archive is set, into the zip directory with a new random key. A
+// non-empty filename replaces the name the recipient saves the file under. It
+// returns the path of the encrypted file and the encoded key, which only
+// ever appears in the fragment of the link.
+func createE2EFile(path string, info os.FileInfo, archive *utils.ArchiveOptions, filename string) (string, string, error) {
+	key, encodedKey, err := utils.GenerateE2EKey()
+	if err != nil {
+		return "", "", err
+	}
+	if err := os.MkdirAll(config.ZipDirectory, 0755); err != nil {
+		return "", "", fmt.Errorf("could not create directory: %v", err)
+	}
+
+	var source io.Reader
+	var meta utils.E2EMetadata
+	if archive == nil {
+		file, err := os.Open(path)
+		if err != nil {
+			return "", "", fmt.Errorf("could not open file: %v", err)
+		}
+		defer file.Close()
+		source = file
+		meta = utils.E2EMetadata{Name: filepath.Base(path), Type: mime.TypeByExtension(filepath.Ext(path)), Size: info.Size()}
+	} else {
+		// The archive is encrypted as it is written, so no plaintext copy
+		// of it reaches the disk. Only large files compressed ahead of
+		// their turn are spooled, next to the encrypted file.
+		options := *archive
+		options.TempDir = config.ZipDirectory
+		reader, writer := io.Pipe()
+		defer reader.Close()
+		go func() {
+			writer.CloseWithError(utils.WriteArchive(writer, path, options))
+		}()
+		source = reader
+		meta = utils.E2EMetadata{Name: filepath.Base(path) + archive.Extension(), Type: archive.ContentType()}
+	}
+	if filename != "" {
+		meta.Name = filename
+	}
+	if meta.Type == "" {
+		meta.Type = "application/octet-stream"
+	}
+
+	encrypted, err := os.CreateTemp(config.ZipDirectory, ".e2e-*")
+	if err != nil {
+		return "", "", fmt.Errorf("could not create encrypted file: %v", err)
+	}
+	defer os.Remove(encrypted.Name())
+
+	buffered := bufio.NewWriter(encrypted)
+	err = utils.EncryptE2E(buffered, source, key, meta)
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if closeErr := encrypted.Close(); err == nil && closeErr != nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("could not encrypt file: %v", err)
+	}
+
+	name, err := utils.GenerateRandomSalt(32)
+	if err != nil {
+		return "", "", err
+	}
+	encryptedPath := filepath.Join(config.ZipDirectory, name+e2eExtension)
+	if err := os.Chmod(encrypted.Name(), 0644); err != nil {
+		return "", "", fmt.Errorf("could not set encrypted file permissions: %v", err)
+	}
+	if err := os.Rename(encrypted.Name(), encryptedPath); err != nil {
+		return "", "", fmt.Errorf("could not move encrypted file: %v", err)
+	}
+	return encryptedPath, encodedKey, nil
+}
+
+type e2ePage struct {
+	Size string
+}
+
+// serveE2E serves the decryption page of an end-to-end encrypted link, and
+// the encrypted file itself to the page's script when requested with ?raw.
+func serveE2E(w http.ResponseWriter, r *http.Request, entry store.Entry, info os.FileInfo) {
+	if _, raw := r.URL.Query()["raw"]; raw {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Cache-Control", "no-store")
+		serveFile(w, r, entry, info)
+		return
+	}
+	log.Printf("Serving decryption page for hash: %s", entry.Hash)
+	renderTemplate(w, http.StatusOK, "e2e.html", e2ePage{Size: utils.FormatBytes(info.Size())})
+}
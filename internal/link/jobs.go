@@ -0,0 +1,169 @@
+package link
+
+import (
+	"fenfa/internal/config"
+	"fenfa/internal/store"
+	"fenfa/pkg/utils"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// jobProgressInterval limits how often a running job stores its progress.
+const jobProgressInterval = time.Second
+
+// RunJobs builds the archives of pending jobs, one at a time, until none
+// is left.
+func RunJobs() {
+	for {
+		job, ok, err := store.NextJob()
+		if err != nil {
+			log.Printf("Jobs: error fetching next job: %v", err)
+			return
+		}
+		if !ok {
+			return
+		}
+		runJob(job)
+	}
+}
+
+func runJob(job store.Job) {
+	entry, _, exists := store.Get(job.Hash)
+	if !exists {
+		log.Printf("Jobs: link %s no longer exists, dropping its job", job.Hash)
+		store.DeleteJob(job.Hash)
+		return
+	}
+
+	log.Printf("Jobs: preparing archive of %s for hash: %s", job.Source, job.Hash)
+	archivePath, err := prepareArchive(&job, entry)
+	if err == nil {
+		exists, err = store.SetStatus(job.Hash, store.StatusReady, archivePath)
+		if err == nil && !exists {
+			log.Printf("Jobs: link %s was revoked while its archive was prepared", job.Hash)
+			if err := removeArchive(archivePath); err != nil {
+				log.Printf("Jobs: error removing archive %s: %v", archivePath, err)
+			}
+			store.DeleteJob(job.Hash)
+			return
+		}
+	}
+	if err == nil {
+		archivePath, err = retainArchive(job.Hash, archivePath, func() (string, error) {
+			return prepareArchive(&job, entry)
+		})
+	}
+
+	if err != nil {
+		log.Printf("Jobs: error preparing archive of %s for hash %s: %v", job.Source, job.Hash, err)
+		if _, statusErr := store.SetStatus(job.Hash, store.StatusFailed, ""); statusErr != nil {
+			log.Printf("Jobs: error updating link %s: %v", job.Hash, statusErr)
+		}
+	} else {
+		log.Printf("Jobs: archive ready: %s for hash: %s", archivePath, job.Hash)
+	}
+	if err := store.FinishJob(job.Hash, err); err != nil {
+		log.Printf("Jobs: error finishing job %s: %v", job.Hash, err)
+	}
+}
+
+// prepareArchive builds the archive of a link created with --async,
+// recording progress in the job as it goes.
+func prepareArchive(job *store.Job, entry store.Entry) (string, error) {
+	archive := entryArchiveOptions(entry)
+	summary, err := utils.ScanArchive(entry.Source, archive)
+	if err != nil {
+		return "", err
+	}
+	if summary.Size > config.MaxZipSize {
+		return "", fmt.Errorf("directory size %s exceeds the limit of %s",
+			utils.FormatBytes(summary.Size), utils.FormatBytes(config.MaxZipSize))
+	}
+
+	job.FilesTotal, job.BytesTotal = summary.Files, summary.Size
+	if err := store.UpdateJobProgress(*job); err != nil {
+		log.Printf("Jobs: error updating job %s: %v", job.Hash, err)
+	}
+	lastUpdate := time.Now()
+	archive.Progress = func(progress utils.ArchiveProgress) {
+		job.FilesDone, job.BytesDone = progress.Files, progress.Bytes
+		if time.Since(lastUpdate) < jobProgressInterval {
+			return
+		}
+		lastUpdate = time.Now()
+		if err := store.UpdateJobProgress(*job); err != nil {
+			log.Printf("Jobs: error updating job %s: %v", job.Hash, err)
+		}
+	}
+
+	archivePath, err := cachedArchive(entry.Source, archive, summary)
+	if err != nil {
+		return "", err
+	}
+	job.FilesDone, job.BytesDone = job.FilesTotal, job.BytesTotal
+	if err := store.UpdateJobProgress(*job); err != nil {
+		log.Printf("Jobs: error updating job %s: %v", job.Hash, err)
+	}
+	return archivePath, nil
+}
+
+// ListJobs prints every archive job with its progress or error.
+func ListJobs() error {
+	jobs, err := store.ListJobs()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Archive Jobs:")
+	for _, job := range jobs {
+		line := fmt.Sprintf("Source: %s, Status: %s", job.Source, job.Status)
+		if job.FilesTotal > 0 {
+			line += fmt.Sprintf(", Progress: %d%% (%d/%d files, %s/%s)", jobPercent(job),
+				job.FilesDone, job.FilesTotal, utils.FormatBytes(job.BytesDone), utils.FormatBytes(job.BytesTotal))
+		}
+		if job.Error != "" {
+			line += ", Error: " + job.Error
+		}
+		fmt.Printf("%s, Updated: %s, Hash: %s\n", line, time.Unix(job.Updated, 0).Format(time.RFC3339), job.Hash)
+	}
+	return nil
+}
+
+// jobPercent estimates how much of a job is done, by bytes when the tree
+// has content and by files otherwise.
+func jobPercent(job store.Job) int {
+	if job.BytesTotal > 0 {
+		return int(job.BytesDone * 100 / job.BytesTotal)
+	}
+	if job.FilesTotal > 0 {
+		return job.FilesDone * 100 / job.FilesTotal
+	}
+	return 0
+}
+
+type preparingPage struct {
+	Failed  bool
+	Percent int
+}
+
+// servePreparing tells recipients that the archive of a link is not ready
+// yet, or could not be built.
+func servePreparing(w http.ResponseWriter, entry store.Entry) {
+	page := preparingPage{Failed: entry.Status == store.StatusFailed}
+	if job, ok, err := store.GetJob(entry.Hash); err != nil {
+		log.Printf("Error getting job for hash %s: %v", entry.Hash, err)
+	} else if ok {
+		page.Percent = jobPercent(job)
+	}
+
+	if page.Failed {
+		log.Printf("Attempted access of failed link: %s", entry.Hash)
+		renderTemplate(w, http.StatusInternalServerError, "preparing.html", page)
+		return
+	}
+	log.Printf("Attempted access of link being prepared: %s", entry.Hash)
+	w.Header().Set("Retry-After", "10")
+	renderTemplate(w, http.StatusServiceUnavailable, "preparing.html", page)
+}
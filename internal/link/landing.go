@@ -0,0 +1,208 @@
+package link
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fenfa/internal/config"
+	"fenfa/internal/store"
+	"fenfa/pkg/utils"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// checksumWait is how long the landing page waits for a checksum that is
+// being computed before it is shown without one.
+const checksumWait = 2 * time.Second
+
+// checksumRetry is how long a file version that could not be hashed is
+// shown without a checksum before hashing it is tried again.
+const checksumRetry = 10 * time.Minute
+
+// checksumKey identifies a version of a file, so a file that changes while
+// it is hashed gets a computation of its own.
+type checksumKey struct {
+	path     string
+	size     int64
+	modified int64
+}
+
+// checksums tracks the files being hashed, so concurrent views of landing
+// pages share one computation per file version, and when hashing a version
+// last failed, so it is not read again on every view until checksumRetry
+// has passed.
+var checksums = struct {
+	sync.Mutex
+	running map[checksumKey]chan struct{}
+	failed  map[checksumKey]time.Time
+}{running: map[checksumKey]chan struct{}{}, failed: map[checksumKey]time.Time{}}
+
+// checksumSlots limits hashing to one file at a time, so views of many
+// landing pages do not read all their files at once. Other files wait
+// their turn, shown as pending meanwhile.
+var checksumSlots = make(chan struct{}, 1)
+
+type landing struct {
+	Name          string
+	Size          string // Empty for archives built at download time
+	Expires       string
+	DownloadsLeft int // 0 for unlimited
+	SHA256        string
+	Pending       bool // The checksum is still being computed
+	DownloadURL   string
+}
+
+// landingEnabled reports whether a link shows a landing page, by its own
+// setting or else FENFA_LANDING_PAGE. Only links to a single download have
+// one.
+func landingEnabled(entry store.Entry) bool {
+	if entry.Mode != store.ModeFile && entry.Mode != store.ModeLive {
+		return false
+	}
+	switch entry.Landing {
+	case store.LandingPage:
+		return true
+	case store.LandingDirect:
+		return false
+	}
+	return config.LandingPage
+}
+
+// directURL returns the URL that downloads a link without its landing page.
+func directURL(entry store.Entry) string {
+	return linkURL(entry.Hash) + "/" + url.PathEscape(downloadName(entry))
+}
+
+// landingRequested reports whether a request gets the landing page instead
+// of the download. It applies to the bare URL of a link; /<hash>/<name> and
+// ?download always download, so the file stays reachable for scripts.
+func landingRequested(r *http.Request, entry store.Entry) bool {
+	if !landingEnabled(entry) {
+		return false
+	}
+	if _, rest := splitLinkPath(r.URL.Path); rest != "" {
+		return false
+	}
+	_, download := r.URL.Query()["download"]
+	return !download
+}
+
+// serveLanding shows what a link downloads, with a button to start it.
+// Viewing the page does not count as a download, so link previews do not
+// use up one-time links.
+func serveLanding(w http.ResponseWriter, r *http.Request, entry store.Entry, info os.FileInfo) {
+	name := downloadName(entry)
+	page := landing{
+		Name:        name,
+		Expires:     time.Unix(entry.Expiration, 0).UTC().Format("2 January 2006, 15:04 MST"),
+		DownloadURL: "/" + entry.Hash + "/" + url.PathEscape(name),
+	}
+	if entry.MaxDownloads > 0 {
+		page.DownloadsLeft = entry.MaxDownloads - entry.DownloadCount
+	}
+	if entry.Mode == store.ModeFile {
+		file, _, size, err := openDownload(entry, info)
+		if err != nil {
+			log.Printf("Error opening file at path: %s: %v", entry.Path, err)
+			ServeError(w, r, http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+		file.Close()
+		page.Size = utils.FormatBytes(size)
+		page.SHA256, page.Pending = checksum(entry, info)
+	}
+
+	log.Printf("Serving landing page for hash: %s", entry.Hash)
+	renderTemplate(w, http.StatusOK, "landing.html", page)
+}
+
+// checksum returns the SHA-256 of a link's download. It is computed in the
+// background on first use and cached; pending is true while that is still
+// running after checksumWait. Files over FENFA_MAX_CHECKSUM_SIZE are not
+// hashed.
+func checksum(entry store.Entry, info os.FileInfo) (sum string, pending bool) {
+	key := checksumKey{path: entry.Path, size: info.Size(), modified: info.ModTime().UnixNano()}
+	if key.size > config.MaxChecksumSize {
+		return "", false
+	}
+	if sum, ok, err := store.GetChecksum(key.path, key.size, key.modified); err != nil {
+		log.Printf("Error getting checksum of %s: %v", entry.Path, err)
+	} else if ok {
+		return sum, false
+	}
+
+	checksums.Lock()
+	if failedAt, ok := checksums.failed[key]; ok {
+		if time.Since(failedAt) < checksumRetry {
+			checksums.Unlock()
+			return "", false
+		}
+		delete(checksums.failed, key)
+	}
+	done, running := checksums.running[key]
+	if !running {
+		done = make(chan struct{})
+		checksums.running[key] = done
+		go computeChecksum(entry, info, key, done)
+	}
+	checksums.Unlock()
+
+	select {
+	case <-done:
+	case <-time.After(checksumWait):
+		return "", true
+	}
+	sum, _, err := store.GetChecksum(key.path, key.size, key.modified)
+	if err != nil {
+		log.Printf("Error getting checksum of %s: %v", entry.Path, err)
+	}
+	return sum, false
+}
+
+func computeChecksum(entry store.Entry, info os.FileInfo, key checksumKey, done chan struct{}) {
+	failed := true
+	defer func() {
+		checksums.Lock()
+		delete(checksums.running, key)
+		if failed {
+			now := time.Now()
+			// Failures of versions that are not viewed again would
+			// otherwise be kept forever.
+			for other, failedAt := range checksums.failed {
+				if now.Sub(failedAt) >= checksumRetry {
+					delete(checksums.failed, other)
+				}
+			}
+			checksums.failed[key] = now
+		}
+		checksums.Unlock()
+		close(done)
+	}()
+
+	checksumSlots <- struct{}{}
+	defer func() { <-checksumSlots }()
+
+	file, content, _, err := openDownload(entry, info)
+	if err != nil {
+		log.Printf("Error opening file at path: %s: %v", entry.Path, err)
+		return
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, content); err != nil {
+		log.Printf("Error computing checksum of %s: %v", entry.Path, err)
+		return
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if err := store.SetChecksum(key.path, key.size, key.modified, sum); err != nil {
+		log.Printf("Error storing checksum of %s: %v", entry.Path, err)
+		return
+	}
+	failed = false
+	log.Printf("Computed checksum of %s", entry.Path)
+}
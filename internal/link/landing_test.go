@@ -0,0 +1,120 @@
+package link
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fenfa/internal/config"
+	"fenfa/internal/store"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestChecksum(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		limit  int64
+		summed bool
+	}{
+		{"small file", 1000, 1 << 20, true},
+		{"at the limit", 1000, 1000, true},
+		{"over the limit", 1001, 1000, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupArchives(t)
+			config.MaxChecksumSize = tt.limit
+			content := make([]byte, tt.size)
+			path := filepath.Join(t.TempDir(), "file.bin")
+			if err := os.WriteFile(path, content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entry := store.Entry{Hash: "link", Expiration: time.Now().Add(time.Hour).Unix(), Path: path, Mode: store.ModeFile}
+
+			// Concurrent views share one computation and all see its result.
+			var wg sync.WaitGroup
+			sums := make([]string, 5)
+			for i := range sums {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					sum, pending := checksum(entry, info)
+					if pending {
+						t.Error("checksum still pending")
+					}
+					sums[i] = sum
+				}(i)
+			}
+			wg.Wait()
+
+			want := ""
+			if tt.summed {
+				digest := sha256.Sum256(content)
+				want = hex.EncodeToString(digest[:])
+			}
+			for _, sum := range sums {
+				if sum != want {
+					t.Errorf("checksum = %q, want %q", sum, want)
+				}
+			}
+		})
+	}
+}
+
+func TestChecksumRetry(t *testing.T) {
+	setupArchives(t)
+	config.MaxChecksumSize = 1 << 20
+	content := []byte("content")
+	path := filepath.Join(t.TempDir(), "file.bin")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := store.Entry{Hash: "link", Expiration: time.Now().Add(time.Hour).Unix(), Path: path, Mode: store.ModeFile}
+	key := checksumKey{path: path, size: info.Size(), modified: info.ModTime().UnixNano()}
+	stale := checksumKey{path: "gone.bin"}
+	checksums.Lock()
+	checksums.failed[stale] = time.Now().Add(-checksumRetry)
+	checksums.Unlock()
+
+	// The file is gone, so hashing it fails.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if sum, _ := checksum(entry, info); sum != "" {
+		t.Fatalf("checksum of missing file = %q", sum)
+	}
+	checksums.Lock()
+	_, failed := checksums.failed[key]
+	_, kept := checksums.failed[stale]
+	checksums.Unlock()
+	if !failed || kept {
+		t.Fatalf("failed = %v and expired failure kept = %v, want true and false", failed, kept)
+	}
+
+	// Within checksumRetry the failure is remembered, after it the file
+	// is hashed again.
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if sum, _ := checksum(entry, info); sum != "" {
+		t.Errorf("checksum retried before checksumRetry: %q", sum)
+	}
+	checksums.Lock()
+	checksums.failed[key] = time.Now().Add(-checksumRetry)
+	checksums.Unlock()
+	digest := sha256.Sum256(content)
+	if sum, _ := checksum(entry, info); sum != hex.EncodeToString(digest[:]) {
+		t.Errorf("checksum after checksumRetry = %q, want %x", sum, digest)
+	}
+}
@@ -1,19 +1,75 @@
 package link
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fenfa/internal/config"
 	"fenfa/internal/store"
 	"fenfa/pkg/utils"
 	"fmt"
+	"io"
 	"log"
+	"mime"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
-func GenerateFileLink(path string) {
+// Options controls how GenerateFileLink creates a link.
+type Options struct {
+	Expires time.Duration // Relative lifetime of the link, e.g. 2h or 7d
+	Until   time.Time     // Absolute expiration, takes precedence over Expires
+
+	MaxDownloads int    // Number of completed downloads allowed, 0 for unlimited
+	Password     string // Password recipients must enter before downloading
+	Browse       bool   // Serve a directory as a browsable index instead of a zip
+	Live         bool   // Stream an archive of a directory built at download time
+	Format       string // Archive format for directories, see utils.ValidFormat
+
+	Include   []string // Patterns files in a directory must match to be shared
+	Exclude   []string // Patterns of files and directories to leave out
+	GitIgnore bool     // Honor .gitignore files when archiving directories
+	Symlinks  string   // Symlink policy, defaults to FENFA_SYMLINK_POLICY or the default of the format
+
+	Deterministic  bool   // Normalize timestamps and permissions for reproducible archives
+	StoreOnly      bool   // Store files in zip archives without compression
+	EncryptArchive bool   // Encrypt the zip archive of a directory, with Passphrase
+	Passphrase     string // Passphrase of the encrypted archive, empty on a dry run
+	ShowPassphrase bool   // Print the passphrase, e.g. when it was generated
+	E2E            bool   // Encrypt with a key that is only part of the URL fragment
+	Filename       string // Name downloads are offered under, instead of the name of the shared path
+	Landing        string // One of the store.Landing values
+	MaxDepth       *int   // Directory levels to include, negative for unlimited, nil for FENFA_MAX_ZIP_DEPTH
+	Strict         bool   // Refuse to share a directory when anything would be left out
+	DryRun         bool   // Report what would be shared without creating the link
+	Async          bool   // Register the link now and let the daemon build the archive
+	Quiet          bool   // Print only the URL and errors, no warnings or progress
+
+	MaxUploadSize     int64    // Per-file size limit for upload links
+	AllowedExtensions []string // Extensions accepted by upload links, e.g. ".pdf"
+}
+
+// expiration resolves the expiration timestamp for a new link, falling back
+// to the configured default period when no option is set.
+func (o Options) expiration(now time.Time) int64 {
+	if !o.Until.IsZero() {
+		return o.Until.Unix()
+	}
+	if o.Expires > 0 {
+		return now.Add(o.Expires).Unix()
+	}
+	return now.Add(time.Duration(config.ExpirationPeriod) * time.Second).Unix()
+}
+
+func GenerateFileLink(path string, opts Options) {
 	absolutePath, err := utils.ResolveToAbsolutePath(path)
 	if err != nil {
 		log.Fatalf("Error resolving path: %v", err)
@@ -26,112 +82,745 @@ func GenerateFileLink(path string) {
 		return
 	}
 
+	source := absolutePath
+	mode := store.ModeFile
+	status := store.StatusReady
+	var fragment string
+	var rebuild func() (string, error)
+	var archiveOptions string
 	if info.IsDir() {
-		estimatedSize, err := utils.EstimateZipSize(absolutePath, config.MaxZipDepth)
+		archive := defaultArchiveOptions()
+		if opts.Format != "" {
+			archive.Format = opts.Format
+		}
+		archive.Include = opts.Include
+		archive.Exclude = opts.Exclude
+		archive.GitIgnore = opts.GitIgnore
+		if opts.Symlinks != "" {
+			archive.Symlinks = opts.Symlinks
+		}
+		if archive.Symlinks == "" {
+			archive.Symlinks = utils.DefaultSymlinkPolicy(archive.Format)
+		}
+		if opts.EncryptArchive && archive.Symlinks == utils.SymlinkPreserve {
+			fmt.Println("Error: symlinks cannot be preserved in an encrypted archive, choose another --symlinks policy")
+			return
+		}
+		archive.Deterministic = opts.Deterministic
+		archive.StoreOnly = opts.StoreOnly
+		archive.Passphrase = opts.Passphrase
+		if opts.MaxDepth != nil {
+			archive.MaxDepth = *opts.MaxDepth
+		}
+		encoded, err := json.Marshal(archive)
 		if err != nil {
-			log.Printf("Error checking file information: %s", absolutePath)
-			fmt.Printf("Error estimating zip size: %v\n", err)
+			fmt.Printf("Error: Could not encode archive options: %v\n", err)
 			return
 		}
+		archiveOptions = string(encoded)
 
-		if estimatedSize > config.MaxZipSize {
-			log.Printf("Error checking file information: %s", absolutePath)
-			fmt.Printf("Error: Directory size exceeds the limit of %d bytes\n", config.MaxZipSize)
+		if opts.DryRun {
+			dryRun(absolutePath, info, &archive, opts)
 			return
 		}
-
-		zipPath, err := utils.ZipDirectory(absolutePath, config.MaxZipDepth)
+		summary, ok := checkArchive(absolutePath, archive, opts)
+		if !ok {
+			return
+		}
+		switch {
+		case opts.Browse:
+			mode = store.ModeBrowse
+		case opts.Live:
+			mode = store.ModeLive
+		case opts.E2E:
+			mode = store.ModeE2E
+			progress := newProgress(opts, "Encrypting", summary.Files, summary.Size)
+			archive.Progress = func(p utils.ArchiveProgress) { progress.Update(p.Files, p.Bytes) }
+			encrypted, key, err := createE2EFile(absolutePath, info, &archive, opts.Filename)
+			progress.Finish()
+			if err != nil {
+				log.Printf("Error encrypting: %s: %v", absolutePath, err)
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			absolutePath, fragment = encrypted, key
+		case opts.Async:
+			status = store.StatusPreparing
+		default:
+			progress := newProgress(opts, "Archiving", summary.Files, summary.Size)
+			archive.Progress = func(p utils.ArchiveProgress) { progress.Update(p.Files, p.Bytes) }
+			archivePath, err := cachedArchive(absolutePath, archive, summary)
+			progress.Finish()
+			if err != nil {
+				log.Printf("Error checking file information: %s", absolutePath)
+				fmt.Printf("Error archiving directory: %v\n", err)
+				return
+			}
+			absolutePath = archivePath
+			rebuilt := archive
+			rebuilt.Progress = nil
+			rebuild = func() (string, error) { return cachedArchive(source, rebuilt, summary) }
+		}
+	} else if opts.Browse || opts.Live || opts.Async || opts.EncryptArchive {
+		fmt.Printf("Error: --browse, --live, --async and --encrypt-archive require a directory: %s\n", absolutePath)
+		return
+	} else if opts.DryRun {
+		dryRun(absolutePath, info, nil, opts)
+		return
+	} else if opts.E2E {
+		mode = store.ModeE2E
+		encrypted, key, err := createE2EFile(absolutePath, info, nil, opts.Filename)
 		if err != nil {
-			log.Printf("Error checking file information: %s", absolutePath)
-			fmt.Printf("Error zipping directory: %v\n", err)
+			log.Printf("Error encrypting: %s: %v", absolutePath, err)
+			fmt.Printf("Error: %v\n", err)
 			return
 		}
+		absolutePath, fragment = encrypted, key
+	}
 
-		err = os.MkdirAll(config.ZipDirectory, 0755)
+	expiration := opts.expiration(time.Now())
+	hash, err := utils.Encode(absolutePath)
+	if err != nil {
+		log.Printf("Error hashing path: %s", path)
+		fmt.Printf("Error: Could not hash path: %v\n", err)
+		return
+	}
+	passwordHash, err := hashPassword(opts.Password)
+	if err != nil {
+		log.Printf("Error hashing password for: %s", absolutePath)
+		fmt.Printf("Error: Could not hash password: %v\n", err)
+		return
+	}
+
+	entry := store.Entry{
+		Hash:         hash,
+		Expiration:   expiration,
+		Path:         absolutePath,
+		Source:       source,
+		MaxDownloads: opts.MaxDownloads,
+		PasswordHash: passwordHash,
+		Mode:         mode,
+
+		ArchiveOptions: archiveOptions,
+		Status:         status,
+		Filename:       opts.Filename,
+		Landing:        opts.Landing,
+	}
+	err = store.Add(entry)
+	if err != nil {
+		log.Printf("Error storing link for: %s: %v", absolutePath, err)
+		fmt.Printf("Error: Could not store link: %v\n", err)
+		return
+	}
+	if rebuild != nil {
+		absolutePath, err = retainArchive(hash, absolutePath, rebuild)
 		if err != nil {
-			log.Printf("Error checking file information: %s", absolutePath)
-			fmt.Printf("Error: Could not create directory: %v\n", err)
+			log.Printf("Error archiving directory: %s: %v", source, err)
+			fmt.Printf("Error archiving directory: %v\n", err)
+			store.Delete(hash)
+			return
+		}
+	}
+	if status == store.StatusPreparing {
+		if err := store.AddJob(hash, source); err != nil {
+			log.Printf("Error queueing archive job for: %s: %v", source, err)
+			fmt.Printf("Error: Could not queue archive job: %v\n", err)
+			store.Delete(hash)
 			return
 		}
+		if !opts.Quiet {
+			fmt.Fprintln(os.Stderr, "The archive is being prepared by the daemon, see fenfa jobs for progress.")
+		}
+	}
+	url := linkURL(hash)
+	log.Printf("Generated link: %s for file: %s, expires: %s", url, absolutePath, time.Unix(expiration, 0).Format(time.RFC3339))
+	if fragment != "" {
+		// The key is printed but never logged or stored.
+		url += "#" + fragment
+	}
+	fmt.Println(url)
+	if landingEnabled(entry) && !opts.Quiet {
+		fmt.Fprintf(os.Stderr, "Direct download, without the landing page: %s\n", directURL(entry))
+	}
+	if opts.ShowPassphrase {
+		// Printed to stderr, even with --quiet, so scripts capturing the
+		// URL keep the passphrase apart for a different channel.
+		fmt.Fprintf(os.Stderr, "Archive passphrase: %s\n", opts.Passphrase)
+	}
+}
 
-		finalZipPath := filepath.Join(config.ZipDirectory, filepath.Base(zipPath))
-		err = os.Rename(zipPath, finalZipPath)
-		if err != nil {
-			log.Printf("Error checking file information: %s", path)
-			fmt.Printf("Error: Could not move zip file: %v\n", err)
+// checkArchive reports whether a directory can be shared, printing the
+// reason when it cannot. Entries and subtrees that will be left out are
+// listed as warnings, and refuse the link in strict mode. Archived links
+// must also fit within the configured archive size limit.
+func checkArchive(dir string, archive utils.ArchiveOptions, opts Options) (utils.ArchiveSummary, bool) {
+	progress := newProgress(opts, "Scanning", 0, 0)
+	var files int
+	var size int64
+	summary, err := utils.ListArchive(dir, archive, func(entry utils.WalkEntry) {
+		if entry.Info.IsDir() {
 			return
 		}
+		files++
+		if entry.Info.Mode().IsRegular() {
+			size += entry.Info.Size()
+		}
+		progress.Update(files, size)
+	})
+	progress.Finish()
+	if err != nil {
+		log.Printf("Error checking file information: %s", dir)
+		fmt.Printf("Error estimating archive size: %v\n", err)
+		return summary, false
+	}
 
-		absolutePath = finalZipPath
+	for _, skipped := range summary.Skipped {
+		log.Printf("Skipping %s in %s: %s", skipped.RelPath, dir, skipped.Reason)
+		if !opts.Quiet {
+			fmt.Fprintf(os.Stderr, "Warning: skipping %s: %s\n", skipped.RelPath, skipped.Reason)
+		}
+	}
+	if !opts.Quiet {
+		printTruncated(summary, archive.MaxDepth)
 	}
 
-	expiration := time.Now().Add(time.Duration(config.DefaultExpirationPeriod) * time.Second).Unix()
-	hash, err := utils.Encode(absolutePath)
+	if opts.Strict && (len(summary.Skipped) > 0 || len(summary.Truncated) > 0) {
+		log.Printf("Refusing incomplete link for: %s", dir)
+		fmt.Println("Error: Some files would be left out, refusing to create the link (--strict)")
+		return summary, false
+	}
+
+	if !opts.Browse && summary.Size > config.MaxZipSize {
+		log.Printf("Error checking file information: %s", dir)
+		fmt.Printf("Error: Directory size exceeds the limit of %d bytes\n", config.MaxZipSize)
+		return summary, false
+	}
+	return summary, true
+}
+
+// newProgress returns a progress reporter for a CLI operation, or nil when
+// progress output is turned off.
+func newProgress(opts Options, label string, totalFiles int, totalBytes int64) *utils.ProgressReporter {
+	if opts.Quiet {
+		return nil
+	}
+	return utils.NewProgressReporter(label, totalFiles, totalBytes)
+}
+
+// cachedArchive returns an archive of dir in the zip directory, reusing an
+// existing one when an unchanged tree was already archived with the same
+// options. Archives are shared by every link with the same fingerprint and
+// removed once the last of them is gone, see RemoveEntry. Encrypted
+// archives are always built for their own link. Unless FENFA_ENCRYPT_AT_REST
+// is off, archives are encrypted at rest with the server key.
+func cachedArchive(dir string, archive utils.ArchiveOptions, summary utils.ArchiveSummary) (string, error) {
+	if err := os.MkdirAll(config.ZipDirectory, 0755); err != nil {
+		return "", fmt.Errorf("could not create directory: %v", err)
+	}
+
+	key, err := atRestKey()
 	if err != nil {
-		log.Printf("Error hashing path: %s", path)
-		fmt.Printf("Error: Could not hash path: %v\n", err)
+		return "", err
+	}
+	archive.AtRestKey = key
+
+	archivePath := filepath.Join(config.ZipDirectory, summary.Fingerprint+archive.FileExtension())
+	if info, err := os.Stat(archivePath); err == nil && info.Mode().IsRegular() && archive.Passphrase == "" {
+		log.Printf("Reusing cached archive: %s for: %s", archivePath, dir)
+		return archivePath, nil
+	}
+	return utils.CreateArchive(dir, config.ZipDirectory, archive)
+}
+
+// retainArchive checks that the archive at path still exists once a link
+// referencing it is stored. Until then removeArchive could count no link
+// using a reused archive and delete it, in which case it is built again
+// with rebuild and the link updated to point at the new archive.
+func retainArchive(hash, path string, rebuild func() (string, error)) (string, error) {
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	log.Printf("Archive %s was removed before its link was stored, building it again", path)
+	rebuilt, err := rebuild()
+	if err != nil {
+		return "", err
+	}
+	if rebuilt != path {
+		exists, err := store.SetStatus(hash, store.StatusReady, rebuilt)
+		if err != nil || !exists {
+			removeArchive(rebuilt)
+			return "", err
+		}
+	}
+	return rebuilt, nil
+}
+
+// atRestKey returns the key archives in the zip directory are encrypted
+// with, creating it on first use, or nil when FENFA_ENCRYPT_AT_REST is off.
+func atRestKey() ([]byte, error) {
+	if !config.EncryptAtRest {
+		return nil, nil
+	}
+	return utils.LoadOrCreateKeyFile(config.ArchiveKeyFile)
+}
+
+// printTruncated summarizes the subtrees left out by the depth limit.
+func printTruncated(summary utils.ArchiveSummary, maxDepth int) {
+	if len(summary.Truncated) == 0 {
 		return
 	}
-	store.Add(hash, expiration, absolutePath)
-	var url string
+	fmt.Fprintf(os.Stderr, "Warning: depth limit of %d leaves out %d file(s) in %d folder(s):\n",
+		maxDepth, summary.OmittedFiles(), len(summary.Truncated))
+	for _, truncated := range summary.Truncated {
+		fmt.Fprintf(os.Stderr, "  %s (%d file(s))\n", truncatedName(truncated), truncated.Files)
+	}
+	fmt.Fprintln(os.Stderr, "Use --max-depth to raise the limit, or -1 for unlimited.")
+}
+
+// truncatedName formats the folder of a truncated subtree for display.
+func truncatedName(truncated utils.TruncatedEntry) string {
+	if truncated.RelPath == "" {
+		return "./"
+	}
+	return truncated.RelPath + "/"
+}
+
+// downloadName returns the name a link's download is offered under: the
+// --filename override, or the name of the shared file or directory, with
+// the archive extension for directories. End-to-end encrypted links carry
+// the name inside the ciphertext, so their raw download keeps the name of
+// the encrypted file.
+func downloadName(entry store.Entry) string {
+	switch {
+	case entry.Mode == store.ModeE2E:
+		return filepath.Base(entry.Path)
+	case entry.Filename != "":
+		return entry.Filename
+	case entry.ArchiveOptions != "":
+		return filepath.Base(entry.Source) + entryArchiveOptions(entry).Extension()
+	case entry.Source != "" && entry.Source != entry.Path:
+		// Archived before archive options were stored with links.
+		return filepath.Base(entry.Source) + filepath.Ext(entry.Path)
+	}
+	return filepath.Base(entry.Path)
+}
+
+// defaultArchiveOptions returns the archive options used when a link does
+// not specify its own.
+func defaultArchiveOptions() utils.ArchiveOptions {
+	return utils.ArchiveOptions{
+		Format:   utils.FormatZip,
+		MaxDepth: config.MaxZipDepth,
+		Symlinks: config.SymlinkPolicy,
+		Workers:  config.CompressionWorkers,
+	}
+}
+
+// entryArchiveOptions decodes the archive options stored with a link. Links
+// created before options were stored use the defaults.
+func entryArchiveOptions(entry store.Entry) utils.ArchiveOptions {
+	archive := defaultArchiveOptions()
+	if entry.ArchiveOptions != "" {
+		if err := json.Unmarshal([]byte(entry.ArchiveOptions), &archive); err != nil {
+			log.Printf("Error decoding archive options for hash %s: %v", entry.Hash, err)
+		}
+	}
+	return archive
+}
+
+// linkURL formats the public URL of a link.
+func linkURL(hash string) string {
 	if config.TemplateIncludesPort {
 		// Format with port
-		url = fmt.Sprintf("%s:%d/%s", config.Host, config.Port, hash)
+		return fmt.Sprintf("%s:%d/%s", config.Host, config.Port, hash)
+	}
+	// Format without port
+	return fmt.Sprintf("%s/%s", config.Host, hash)
+}
+
+// hashPassword returns the bcrypt hash of a link password, or an empty
+// string when no password is set.
+func hashPassword(password string) (string, error) {
+	if password == "" {
+		return "", nil
+	}
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashed), nil
+}
+
+// ExtendLink changes the expiration of an existing link, keeping its URL.
+// value is either a duration relative to now or an absolute timestamp.
+func ExtendLink(hash, value string) {
+	now := time.Now()
+	var expiration time.Time
+	if d, err := utils.ParseDuration(value); err == nil {
+		expiration = now.Add(d)
+	} else if t, err := utils.ParseTimestamp(value); err == nil {
+		expiration = t
 	} else {
-		// Format without port
-		url = fmt.Sprintf("%s/%s", config.Host, hash)
+		fmt.Printf("Error: %q is neither a duration nor a timestamp\n", value)
+		return
 	}
-	log.Printf("Generated link: %s for file: %s", url, absolutePath)
-	fmt.Println(url)
+	if !expiration.After(now) {
+		fmt.Printf("Error: new expiration %s is in the past\n", expiration.Format(time.RFC3339))
+		return
+	}
+
+	entry, _, exists := store.Get(hash)
+	if !exists {
+		fmt.Printf("Error: link not found: %s\n", hash)
+		return
+	}
+	if entry.Expiration+config.ExpiredGracePeriod <= now.Unix() {
+		fmt.Printf("Error: link %s expired on %s and is past its grace period\n", hash, time.Unix(entry.Expiration, 0).Format(time.RFC3339))
+		return
+	}
+
+	if err := store.SetExpiration(hash, expiration.Unix()); err != nil {
+		log.Printf("Error extending link %s: %v", hash, err)
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	log.Printf("Extended link: %s for file: %s, expires: %s", hash, entry.Path, expiration.Format(time.RFC3339))
+	fmt.Printf("Link %s now expires %s\n", hash, expiration.Format(time.RFC3339))
 }
 
 func FileHandler(w http.ResponseWriter, r *http.Request) {
 	ip, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
 		log.Printf("Error getting IP: %s", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		ServeError(w, r, http.StatusInternalServerError, "Internal Server Error")
 		return
 	}
 
 	failedAttempts, err := store.GetFailedAttempts(ip)
 	if err != nil {
 		log.Printf("Error getting failed attempts for IP %s: %v", ip, err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		ServeError(w, r, http.StatusInternalServerError, "Internal Server Error")
 		return
 	}
 
 	if failedAttempts >= config.FailedAttemptLimit {
 		log.Printf("Banned IP address: %s", ip)
-		http.Error(w, "Access Denied", http.StatusForbidden)
+		ServeError(w, r, http.StatusForbidden, "Access Denied")
 		return
 	}
-	_, hash := filepath.Split(r.URL.Path)
+	hash, rest := splitLinkPath(r.URL.Path)
 	entry, active, exists := store.Get(hash)
 	if !exists {
 		store.IncrementFailedAttempts(ip)
 		log.Printf("Hash not found in map: %s", hash)
-		http.NotFound(w, r)
+		ServeError(w, r, http.StatusNotFound, "404 page not found")
 		return
 	}
 	if !active {
 		store.IncrementFailedAttempts(ip)
 		log.Printf("Attempted access of expired link by %s: %s", ip, hash)
-		http.Error(w, "Link Expired.", http.StatusGone)
+		ServeError(w, r, http.StatusGone, "Link Expired.")
 		return
 	}
 
-	if _, err := os.Stat(entry.Path); os.IsNotExist(err) {
+	if entry.DownloadsExhausted() {
+		store.IncrementFailedAttempts(ip)
+		log.Printf("Attempted access of exhausted link by %s: %s", ip, hash)
+		serveExhausted(w, r)
+		return
+	}
+
+	info, err := os.Stat(entry.Path)
+	if os.IsNotExist(err) {
 		store.IncrementFailedAttempts(ip)
 		log.Printf("File not found at path: %s", entry.Path)
 		store.Delete(hash)
-		http.NotFound(w, r)
+		ServeError(w, r, http.StatusNotFound, "404 page not found")
 		return
 	} else if err != nil {
 		log.Printf("Error accessing file at path: %s: %v", entry.Path, err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		ServeError(w, r, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	if entry.PasswordHash != "" && !checkPassword(w, r, ip, entry) {
+		return
+	}
+	allowPost := entry.Mode == store.ModeUpload || (entry.Mode == store.ModeFile && entry.PasswordHash != "")
+	if r.Method != http.MethodGet && !(r.Method == http.MethodPost && allowPost) {
+		ServeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if entry.Status != store.StatusReady {
+		servePreparing(w, entry)
+		return
+	}
+	if landingRequested(r, entry) {
+		serveLanding(w, r, entry, info)
+		return
+	}
+
+	// Links to a single download also answer under their name, e.g.
+	// /<hash>/report.pdf, so clients that name files after the URL save
+	// them under the right name.
+	if rest != "" && entry.Mode != store.ModeBrowse && entry.Mode != store.ModeUpload && rest != downloadName(entry) {
+		log.Printf("Name %q does not match link %s", rest, hash)
+		ServeError(w, r, http.StatusNotFound, "404 page not found")
+		return
+	}
+
+	switch entry.Mode {
+	case store.ModeBrowse:
+		serveBrowse(w, r, entry, rest)
+	case store.ModeUpload:
+		serveUpload(w, r, ip, entry)
+	case store.ModeLive:
+		serveArchive(w, r, entry, entry.Path, 0)
+	case store.ModeE2E:
+		serveE2E(w, r, entry, info)
+	default:
+		serveFile(w, r, entry, info)
+	}
+}
+
+// splitLinkPath splits a request path into the link hash and the remainder,
+// e.g. "/<hash>/sub/file.txt" into "<hash>" and "sub/file.txt".
+func splitLinkPath(urlPath string) (hash, rest string) {
+	hash, rest, _ = strings.Cut(strings.TrimPrefix(urlPath, "/"), "/")
+	return hash, rest
+}
+
+func serveFile(w http.ResponseWriter, r *http.Request, entry store.Entry, info os.FileInfo) {
+	if entry.MaxDownloads > 0 {
+		// Partial requests would let a client fetch the whole file without
+		// ever completing a counted download.
+		r.Header.Del("Range")
+	}
+
+	file, content, size, err := openDownload(entry, info)
+	if err != nil {
+		log.Printf("Error opening file at path: %s: %v", entry.Path, err)
+		ServeError(w, r, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	defer file.Close()
+
+	if !claimDownload(w, r, entry) {
+		return
+	}
+	name := downloadName(entry)
+	w.Header().Set("Content-Disposition", utils.ContentDisposition("attachment", name))
+
+	log.Printf("Serving file: %s for hash: %s", entry.Path, entry.Hash)
+	rec := &transferRecorder{ResponseWriter: w}
+	http.ServeContent(rec, r, name, info.ModTime(), content)
+
+	if !rec.completed(size) {
+		releaseDownload(entry)
+	}
+}
+
+// openDownload opens the file of a link and returns its content and size.
+// Archives encrypted at rest are decrypted as the content is read, in the
+// chunks each request needs. The caller closes the file.
+func openDownload(entry store.Entry, info os.FileInfo) (*os.File, io.ReadSeeker, int64, error) {
+	file, err := os.Open(entry.Path)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if !strings.HasSuffix(entry.Path, utils.EncryptedExtension) {
+		return file, file, info.Size(), nil
+	}
+
+	key, err := utils.LoadKeyFile(config.ArchiveKeyFile)
+	if err == nil {
+		var reader *utils.DecryptingReader
+		if reader, err = utils.NewDecryptingReader(file, info.Size(), key); err == nil {
+			return file, reader, reader.Size(), nil
+		}
+	}
+	file.Close()
+	return nil, nil, 0, fmt.Errorf("could not decrypt: %v", err)
+}
+
+// serveArchive streams an archive of a directory at the given depth below
+// the link, honoring the remaining depth limit.
+func serveArchive(w http.ResponseWriter, r *http.Request, entry store.Entry, fullPath string, depth int) {
+	archive := entryArchiveOptions(entry)
+	if archive.MaxDepth >= 0 {
+		archive.MaxDepth -= depth
+	}
+
+	summary, err := utils.ScanArchive(fullPath, archive)
+	if err != nil {
+		log.Printf("Error estimating archive size for %s: %v", fullPath, err)
+		ServeError(w, r, http.StatusInternalServerError, "Internal Server Error")
 		return
 	}
+	if summary.Size > config.MaxZipSize {
+		log.Printf("Refusing to archive %s: estimated size %d exceeds limit", fullPath, summary.Size)
+		ServeError(w, r, http.StatusRequestEntityTooLarge, "Directory is too large to download as an archive.")
+		return
+	}
+
+	if !claimDownload(w, r, entry) {
+		return
+	}
+	name := filepath.Base(fullPath) + archive.Extension()
+	if depth == 0 {
+		name = downloadName(entry)
+	}
+	w.Header().Set("Content-Type", archive.ContentType())
+	w.Header().Set("Content-Disposition", utils.ContentDisposition("attachment", name))
+
+	log.Printf("Streaming archive: %s for hash: %s", fullPath, entry.Hash)
+	if err := utils.WriteArchive(w, fullPath, archive); err != nil {
+		log.Printf("Error streaming archive for %s: %v", fullPath, err)
+		releaseDownload(entry)
+	}
+}
+
+// claimDownload reserves one of the link's downloads before it is served,
+// responding with 410 Gone when none is left. Downloads whose transfer does
+// not complete are given back with releaseDownload, so only completed
+// downloads count.
+func claimDownload(w http.ResponseWriter, r *http.Request, entry store.Entry) bool {
+	claimed, err := store.ClaimDownload(entry.Hash)
+	if err != nil {
+		log.Printf("Error claiming download for hash %s: %v", entry.Hash, err)
+		ServeError(w, r, http.StatusInternalServerError, "Internal Server Error")
+		return false
+	}
+	if !claimed {
+		log.Printf("Download limit reached for hash: %s", entry.Hash)
+		serveExhausted(w, r)
+		return false
+	}
+	return true
+}
+
+func releaseDownload(entry store.Entry) {
+	if err := store.ReleaseDownload(entry.Hash); err != nil {
+		log.Printf("Error releasing download for hash %s: %v", entry.Hash, err)
+	}
+}
+
+// maxPasswordFormSize bounds the body of a password form submission.
+const maxPasswordFormSize = 4 << 10
+
+// checkPassword serves the password form for protected links and reports
+// whether the request carries the correct password. Wrong guesses count as
+// failed attempts towards the IP ban.
+func checkPassword(w http.ResponseWriter, r *http.Request, ip string, entry store.Entry) bool {
+	key, err := utils.LoadOrCreateKeyFile(config.CookieKeyFile)
+	if err != nil {
+		log.Printf("Error loading cookie key: %v", err)
+		ServeError(w, r, http.StatusInternalServerError, "Internal Server Error")
+		return false
+	}
+	if cookie, err := r.Cookie(passwordCookie); err == nil && validPasswordToken(key, entry, cookie.Value) {
+		return true
+	}
+	if r.Method != http.MethodPost {
+		renderTemplate(w, http.StatusOK, "password.html", nil)
+		return false
+	}
+
+	// Only the small form of password.html is read. Other bodies, such as
+	// uploads sent without the cookie, are never parsed or buffered.
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" {
+		renderTemplate(w, http.StatusUnauthorized, "password.html", struct{ Error string }{"Enter the password first."})
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxPasswordFormSize)
+	password := r.PostFormValue("password")
+	if bcrypt.CompareHashAndPassword([]byte(entry.PasswordHash), []byte(password)) != nil {
+		store.IncrementFailedAttempts(ip)
+		log.Printf("Wrong password for hash %s from %s", entry.Hash, ip)
+		renderTemplate(w, http.StatusUnauthorized, "password.html", struct{ Error string }{"Incorrect password."})
+		return false
+	}
+
+	expires := min(time.Now().Add(passwordCookieLifetime).Unix(), entry.Expiration)
+	http.SetCookie(w, &http.Cookie{
+		Name:     passwordCookie,
+		Value:    passwordToken(key, entry, expires),
+		Path:     "/" + entry.Hash,
+		Expires:  time.Unix(expires, 0),
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	if entry.Mode != store.ModeFile || landingRequested(r, entry) {
+		// Pages with further navigation continue as GET, authorized by
+		// the cookie.
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+		return false
+	}
+	return true
+}
+
+// passwordCookie remembers a correct password for the rest of the link,
+// e.g. when navigating a browsable directory.
+const passwordCookie = "fenfa_auth"
+
+// passwordCookieLifetime bounds how long a correct password is remembered.
+const passwordCookieLifetime = 24 * time.Hour
+
+// passwordToken returns the cookie value remembering the password of a link
+// until expires: the expiry and an HMAC of it, the link and its password
+// hash under the cookie key. The key never leaves the server, so the value
+// cannot be forged from the store alone, and it changes with the password.
+func passwordToken(key []byte, entry store.Entry, expires int64) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s:%s:%d", entry.Hash, entry.PasswordHash, expires)
+	return strconv.FormatInt(expires, 10) + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// validPasswordToken reports whether a cookie value was issued by
+// passwordToken for the current password of the link and has not expired.
+func validPasswordToken(key []byte, entry store.Entry, value string) bool {
+	expiry, _, _ := strings.Cut(value, ".")
+	expires, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || time.Now().Unix() >= expires {
+		return false
+	}
+	return hmac.Equal([]byte(value), []byte(passwordToken(key, entry, expires)))
+}
+
+// transferRecorder tracks the status and body size of a response so a
+// download is only counted once the whole file has been sent.
+type transferRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+	err     error
+}
+
+func (t *transferRecorder) WriteHeader(status int) {
+	if t.status == 0 {
+		t.status = status
+	}
+	t.ResponseWriter.WriteHeader(status)
+}
+
+func (t *transferRecorder) Write(p []byte) (int, error) {
+	if t.status == 0 {
+		t.status = http.StatusOK
+	}
+	n, err := t.ResponseWriter.Write(p)
+	t.written += int64(n)
+	if err != nil && t.err == nil {
+		t.err = err
+	}
+	return n, err
+}
 
-	log.Printf("Serving file: %s for hash: %s", entry.Path, hash)
-	http.ServeFile(w, r, entry.Path)
+// completed reports whether a full 200 response of size bytes was written.
+func (t *transferRecorder) completed(size int64) bool {
+	return t.status == http.StatusOK && t.err == nil && t.written == size
 }
@@ -0,0 +1,43 @@
+package link
+
+import (
+	"fenfa/internal/store"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidPasswordToken(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	entry := store.Entry{Hash: "link", PasswordHash: "bcrypt-hash"}
+	expires := time.Now().Add(time.Hour).Unix()
+	token := passwordToken(key, entry, expires)
+	_, mac, _ := strings.Cut(token, ".")
+
+	changed := entry
+	changed.PasswordHash = "new-bcrypt-hash"
+
+	tests := []struct {
+		name  string
+		key   []byte
+		entry store.Entry
+		value string
+		want  bool
+	}{
+		{"issued", key, entry, token, true},
+		{"expired", key, entry, passwordToken(key, entry, time.Now().Add(-time.Second).Unix()), false},
+		{"extended expiry", key, entry, strconv.FormatInt(expires+3600, 10) + "." + mac, false},
+		{"password changed", key, changed, token, false},
+		{"other key", []byte("fedcba9876543210fedcba9876543210"), entry, token, false},
+		{"unsigned", key, entry, strconv.FormatInt(expires, 10), false},
+		{"garbage", key, entry, "not a token", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validPasswordToken(tt.key, tt.entry, tt.value); got != tt.want {
+				t.Errorf("validPasswordToken(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
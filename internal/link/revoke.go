@@ -0,0 +1,176 @@
+package link
+
+import (
+	"fenfa/internal/config"
+	"fenfa/internal/store"
+	"fenfa/pkg/utils"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RevokeOptions selects the links removed by RevokeLinks.
+type RevokeOptions struct {
+	Target     string // Hash, served path or source path of a link
+	AllExpired bool   // Revoke every expired link
+	PathPrefix string // Revoke every link at or below this path
+}
+
+// RevokeLinks removes the selected links and prints what was revoked.
+func RevokeLinks(opts RevokeOptions) {
+	entries, err := selectEntries(opts)
+	if err != nil {
+		log.Printf("Error selecting links to revoke: %v", err)
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if len(entries) == 0 {
+		fmt.Println("No matching links found.")
+		return
+	}
+
+	revoked := 0
+	for _, entry := range entries {
+		if err := RemoveEntry(entry); err != nil {
+			log.Printf("Error revoking link %s: %v", entry.Hash, err)
+			fmt.Printf("Error revoking %s: %v\n", entry.Hash, err)
+			continue
+		}
+		log.Printf("Revoked link: %s for file: %s", entry.Hash, entry.Path)
+		fmt.Printf("Revoked: %s (%s)\n", entry.Hash, entry.Path)
+		revoked++
+	}
+	fmt.Printf("%d link(s) revoked.\n", revoked)
+}
+
+func selectEntries(opts RevokeOptions) ([]store.Entry, error) {
+	seen := make(map[string]bool)
+	var selected []store.Entry
+	add := func(entries []store.Entry, err error) error {
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !seen[entry.Hash] {
+				seen[entry.Hash] = true
+				selected = append(selected, entry)
+			}
+		}
+		return nil
+	}
+
+	if opts.Target != "" {
+		if err := add(store.Find(opts.Target)); err != nil {
+			return nil, err
+		}
+		if absolutePath, err := filepath.Abs(opts.Target); err == nil && absolutePath != opts.Target {
+			if err := add(store.Find(absolutePath)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if opts.AllExpired {
+		if err := add(store.FindExpired(time.Now().Unix())); err != nil {
+			return nil, err
+		}
+	}
+	if opts.PathPrefix != "" {
+		prefix, err := filepath.Abs(opts.PathPrefix)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving path prefix: %v", err)
+		}
+		if err := add(store.FindByPathPrefix(prefix)); err != nil {
+			return nil, err
+		}
+	}
+	return selected, nil
+}
+
+// RemoveEntry deletes a link. Archives generated in the zip directory are
+// removed as well once no other link serves them.
+func RemoveEntry(entry store.Entry) error {
+	if err := store.Delete(entry.Hash); err != nil {
+		return err
+	}
+	if err := store.DeleteJob(entry.Hash); err != nil {
+		return err
+	}
+	return removeArchive(entry.Path)
+}
+
+// removeArchive deletes an archive in the zip directory once no link serves
+// it anymore. Paths outside the zip directory are left alone.
+func removeArchive(path string) error {
+	if !utils.IsWithin(config.ZipDirectory, path) {
+		return nil
+	}
+
+	remaining, err := store.CountByPath(path)
+	if err != nil {
+		return err
+	}
+	if remaining > 0 {
+		return nil
+	}
+
+	// A new link may reuse the archive right after it was counted. Moving
+	// the archive aside before counting again means such a link is either
+	// counted, and the archive put back, or finds it gone and builds it
+	// again, see retainArchive.
+	removing := path + ".removing"
+	if err := os.Rename(path, removing); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("could not remove archive: %v", err)
+	}
+	remaining, err = store.CountByPath(path)
+	if err != nil || remaining > 0 {
+		if renameErr := os.Rename(removing, path); renameErr != nil {
+			return fmt.Errorf("could not restore archive: %v", renameErr)
+		}
+		return err
+	}
+	if err := os.Remove(removing); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not remove archive: %v", err)
+	}
+	if err := store.DeleteChecksum(path); err != nil {
+		log.Printf("Error deleting checksum of %s: %v", path, err)
+	}
+	log.Printf("Removed archive: %s", path)
+	return nil
+}
+
+// PurgeExpired removes links that expired more than the grace period ago,
+// together with their archives, and logs what was reclaimed.
+func PurgeExpired() {
+	cutoff := time.Now().Unix() - config.ExpiredGracePeriod
+	entries, err := store.FindExpired(cutoff)
+	if err != nil {
+		log.Printf("Janitor: error finding expired links: %v", err)
+		return
+	}
+
+	purged := 0
+	var reclaimed int64
+	for _, entry := range entries {
+		var size int64
+		if info, err := os.Stat(entry.Path); err == nil && utils.IsWithin(config.ZipDirectory, entry.Path) {
+			size = info.Size()
+		}
+		if err := RemoveEntry(entry); err != nil {
+			log.Printf("Janitor: error purging link %s: %v", entry.Hash, err)
+			continue
+		}
+		if _, err := os.Stat(entry.Path); os.IsNotExist(err) {
+			reclaimed += size
+		}
+		log.Printf("Janitor: purged link %s for file: %s", entry.Hash, entry.Path)
+		purged++
+	}
+	if purged > 0 {
+		log.Printf("Janitor: purged %d expired link(s), reclaimed %d bytes", purged, reclaimed)
+	}
+}
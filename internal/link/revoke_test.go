@@ -0,0 +1,92 @@
+package link
+
+import (
+	"fenfa/internal/config"
+	"fenfa/internal/store"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func addArchiveLink(t *testing.T, hash, path string) {
+	t.Helper()
+	entry := store.Entry{Hash: hash, Expiration: time.Now().Add(time.Hour).Unix(), Path: path, Mode: store.ModeFile}
+	if err := store.Add(entry); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoveArchive(t *testing.T) {
+	tests := []struct {
+		name       string
+		referenced bool
+		wantExists bool
+	}{
+		{"unreferenced", false, false},
+		{"still referenced", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupArchives(t)
+			path := filepath.Join(config.ZipDirectory, "archive.zip")
+			if err := os.WriteFile(path, []byte("zip"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if tt.referenced {
+				addArchiveLink(t, "other", path)
+			}
+
+			if err := removeArchive(path); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(path); (err == nil) != tt.wantExists {
+				t.Errorf("archive exists = %v, want %v", err == nil, tt.wantExists)
+			}
+			if _, err := os.Stat(path + ".removing"); !os.IsNotExist(err) {
+				t.Errorf("archive moved aside was left behind: %v", err)
+			}
+		})
+	}
+}
+
+func TestRetainArchive(t *testing.T) {
+	tests := []struct {
+		name    string
+		removed bool
+		want    string
+	}{
+		{"archive kept", false, "cached.zip"},
+		{"archive removed", true, "rebuilt.zip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupArchives(t)
+			cached := filepath.Join(config.ZipDirectory, "cached.zip")
+			if err := os.WriteFile(cached, []byte("zip"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			addArchiveLink(t, "link", cached)
+			if tt.removed {
+				os.Remove(cached)
+			}
+
+			rebuild := func() (string, error) {
+				path := filepath.Join(config.ZipDirectory, "rebuilt.zip")
+				return path, os.WriteFile(path, []byte("zip"), 0644)
+			}
+			got, err := retainArchive("link", cached, rebuild)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := filepath.Join(config.ZipDirectory, tt.want)
+			if got != want {
+				t.Errorf("retainArchive() = %q, want %q", got, want)
+			}
+			entry, _, _ := store.Get("link")
+			if entry.Path != want {
+				t.Errorf("link path = %q, want %q", entry.Path, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package link
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//go:embed templates/*.html
+var templateFS embed.FS
+
+var templates = template.Must(template.ParseFS(templateFS, "templates/*.html"))
+
+// errorTemplates maps error statuses to their pages. Other statuses use
+// error.html.
+var errorTemplates = map[int]string{
+	http.StatusForbidden:       "banned.html",
+	http.StatusNotFound:        "notfound.html",
+	http.StatusGone:            "expired.html",
+	http.StatusTooManyRequests: "ratelimited.html",
+}
+
+type errorPage struct {
+	Status  int
+	Title   string // Status text, e.g. "Not Found"
+	Message string // The plain text response, e.g. "Link Expired."
+
+	// Exhausted is set on the 410 page of a link that is still valid but
+	// reached its download limit, rather than expired.
+	Exhausted bool
+}
+
+// LoadTemplates replaces the embedded pages with the files of the same name
+// in dir, e.g. landing.html or expired.html. Pages without a file in dir
+// keep their default, and other files in dir can define templates the
+// pages share. The stylesheet every page includes is the "style" template
+// of style.html.
+func LoadTemplates(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	if info, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("could not read template directory: %v", err)
+	} else if !info.IsDir() {
+		return fmt.Errorf("template directory %s is not a directory", dir)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.html"))
+	if err != nil {
+		return err
+	}
+	set, err := template.ParseFS(templateFS, "templates/*.html")
+	if err != nil {
+		return err
+	}
+	if len(files) > 0 {
+		if set, err = set.ParseFiles(files...); err != nil {
+			return fmt.Errorf("could not parse templates: %v", err)
+		}
+	}
+	templates = set
+	log.Printf("Loaded %d template(s) from %s", len(files), dir)
+	return nil
+}
+
+// renderTemplate writes the named page with the given status code.
+func renderTemplate(w http.ResponseWriter, status int, name string, data interface{}) {
+	var buf bytes.Buffer
+	if err := templates.ExecuteTemplate(&buf, name, data); err != nil {
+		log.Printf("Error rendering template %s: %v", name, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
+
+// ServeError responds with the page for an error status, or with message
+// as plain text to clients that do not accept HTML, such as curl.
+func ServeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	serveErrorPage(w, r, errorPage{Status: status, Title: http.StatusText(status), Message: message})
+}
+
+// serveExhausted responds that a link reached its download limit.
+func serveExhausted(w http.ResponseWriter, r *http.Request) {
+	serveErrorPage(w, r, errorPage{
+		Status:    http.StatusGone,
+		Title:     http.StatusText(http.StatusGone),
+		Message:   "Download limit reached.",
+		Exhausted: true,
+	})
+}
+
+func serveErrorPage(w http.ResponseWriter, r *http.Request, page errorPage) {
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Error(w, page.Message, page.Status)
+		return
+	}
+	name, ok := errorTemplates[page.Status]
+	if !ok {
+		name = "error.html"
+	}
+	renderTemplate(w, page.Status, name, page)
+}
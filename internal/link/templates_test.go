@@ -0,0 +1,41 @@
+package link
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeError(t *testing.T) {
+	tests := []struct {
+		name   string
+		accept string
+		serve  func(w http.ResponseWriter, r *http.Request)
+		want   string
+	}{
+		{"expired page", "text/html", func(w http.ResponseWriter, r *http.Request) {
+			ServeError(w, r, http.StatusGone, "Link Expired.")
+		}, "This link has expired."},
+		{"exhausted page", "text/html", func(w http.ResponseWriter, r *http.Request) {
+			serveExhausted(w, r)
+		}, "downloaded as many times as allowed"},
+		{"exhausted plain text", "*/*", func(w http.ResponseWriter, r *http.Request) {
+			serveExhausted(w, r)
+		}, "Download limit reached."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/hash", nil)
+			r.Header.Set("Accept", tt.accept)
+			w := httptest.NewRecorder()
+			tt.serve(w, r)
+			if w.Code != http.StatusGone {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusGone)
+			}
+			if body := w.Body.String(); !strings.Contains(body, tt.want) {
+				t.Errorf("body does not contain %q:\n%s", tt.want, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package link
+
+import (
+	"errors"
+	"fenfa/internal/config"
+	"fenfa/internal/store"
+	"fenfa/pkg/utils"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type uploadPage struct {
+	MaxSize        string
+	MaxRequestSize string
+	MaxFiles       int
+	Extensions     []string
+	Uploaded       []string
+	Errors         []string
+}
+
+// multipartOverhead allows for the part headers and boundaries of an
+// upload on top of the file contents.
+const multipartOverhead = 1 << 20
+
+// uploadRequestLimit returns how many bytes one upload request may send:
+// FENFA_MAX_UPLOAD_REQUEST_SIZE, but always enough for a single file of
+// the link's maximum size.
+func uploadRequestLimit(entry store.Entry) int64 {
+	limit := config.MaxUploadRequestSize
+	if limit < entry.MaxUploadSize {
+		limit = entry.MaxUploadSize
+	}
+	return limit + multipartOverhead
+}
+
+// CreateUploadLink creates a link where recipients can upload files into dir.
+func CreateUploadLink(dir string, opts Options) {
+	absolutePath, err := filepath.Abs(dir)
+	if err != nil {
+		log.Fatalf("Error resolving path: %v", err)
+	}
+
+	info, err := os.Stat(absolutePath)
+	if err != nil {
+		log.Printf("Error checking directory information: %s", absolutePath)
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if !info.IsDir() {
+		fmt.Printf("Error: not a directory: %s\n", absolutePath)
+		return
+	}
+
+	maxSize := opts.MaxUploadSize
+	if maxSize <= 0 {
+		maxSize = config.MaxUploadSize
+	}
+	var extensions []string
+	for _, ext := range opts.AllowedExtensions {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		extensions = append(extensions, ext)
+	}
+
+	expiration := opts.expiration(time.Now())
+	hash, err := utils.Encode(absolutePath)
+	if err != nil {
+		log.Printf("Error hashing path: %s", absolutePath)
+		fmt.Printf("Error: Could not hash path: %v\n", err)
+		return
+	}
+	passwordHash, err := hashPassword(opts.Password)
+	if err != nil {
+		log.Printf("Error hashing password for: %s", absolutePath)
+		fmt.Printf("Error: Could not hash password: %v\n", err)
+		return
+	}
+
+	err = store.Add(store.Entry{
+		Hash:              hash,
+		Expiration:        expiration,
+		Path:              absolutePath,
+		Source:            absolutePath,
+		PasswordHash:      passwordHash,
+		Mode:              store.ModeUpload,
+		MaxUploadSize:     maxSize,
+		AllowedExtensions: strings.Join(extensions, ","),
+	})
+	if err != nil {
+		log.Printf("Error storing upload link for: %s: %v", absolutePath, err)
+		fmt.Printf("Error: Could not store link: %v\n", err)
+		return
+	}
+
+	url := linkURL(hash)
+	log.Printf("Generated upload link: %s for directory: %s, expires: %s", url, absolutePath, time.Unix(expiration, 0).Format(time.RFC3339))
+	fmt.Println(url)
+}
+
+func serveUpload(w http.ResponseWriter, r *http.Request, ip string, entry store.Entry) {
+	page := uploadPage{
+		MaxSize:        utils.FormatBytes(entry.MaxUploadSize),
+		MaxRequestSize: utils.FormatBytes(uploadRequestLimit(entry) - multipartOverhead),
+		MaxFiles:       config.MaxUploadFiles,
+	}
+	if entry.AllowedExtensions != "" {
+		page.Extensions = strings.Split(entry.AllowedExtensions, ",")
+	}
+
+	if r.Method != http.MethodPost {
+		renderTemplate(w, http.StatusOK, "upload.html", page)
+		return
+	}
+
+	// Bounds the whole request, so many files just under the per-file
+	// limit cannot fill the disk in one upload.
+	r.Body = http.MaxBytesReader(w, r.Body, uploadRequestLimit(entry))
+	reader, err := r.MultipartReader()
+	if err != nil {
+		renderTemplate(w, http.StatusBadRequest, "upload.html", page)
+		return
+	}
+
+	files := 0
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("Error reading upload from %s for hash %s: %v", ip, entry.Hash, err)
+			page.Errors = append(page.Errors, uploadError(err))
+			break
+		}
+		if part.FormName() != "files" || part.FileName() == "" {
+			part.Close()
+			continue
+		}
+		if files++; files > config.MaxUploadFiles {
+			part.Close()
+			log.Printf("Rejected upload from %s for hash %s: more than %d files", ip, entry.Hash, config.MaxUploadFiles)
+			page.Errors = append(page.Errors, fmt.Sprintf("Only %d files can be sent at once, the rest were not uploaded.", config.MaxUploadFiles))
+			break
+		}
+
+		name, err := receiveUpload(entry, page.Extensions, part.FileName(), part)
+		part.Close()
+		var maxBytes *http.MaxBytesError
+		if errors.As(err, &maxBytes) {
+			log.Printf("Rejected upload %q from %s for hash %s: %v", part.FileName(), ip, entry.Hash, err)
+			page.Errors = append(page.Errors, uploadError(err))
+			break
+		}
+		if err != nil {
+			log.Printf("Rejected upload %q from %s for hash %s: %v", part.FileName(), ip, entry.Hash, err)
+			page.Errors = append(page.Errors, fmt.Sprintf("%s: %v", part.FileName(), err))
+			continue
+		}
+		log.Printf("Received upload: %s from %s for hash: %s", filepath.Join(entry.Path, name), ip, entry.Hash)
+		page.Uploaded = append(page.Uploaded, name)
+	}
+
+	status := http.StatusOK
+	if len(page.Uploaded) == 0 && len(page.Errors) > 0 {
+		status = http.StatusBadRequest
+	}
+	renderTemplate(w, status, "upload.html", page)
+}
+
+var errUploadTooLarge = errors.New("file is too large")
+
+// uploadError describes an error reading an upload request to the sender.
+func uploadError(err error) string {
+	var maxBytes *http.MaxBytesError
+	if errors.As(err, &maxBytes) {
+		return fmt.Sprintf("The upload is larger than the limit of %s per request, the rest was not uploaded.",
+			utils.FormatBytes(maxBytes.Limit-multipartOverhead))
+	}
+	return "The upload was interrupted."
+}
+
+// receiveUpload writes one uploaded file into the link's directory and
+// returns the name it was stored under. The file is written to a temporary
+// name first and then hard linked into place, so readers never see partial
+// uploads and existing files are never overwritten.
+func receiveUpload(entry store.Entry, extensions []string, filename string, body io.Reader) (string, error) {
+	name := filepath.Base(strings.ReplaceAll(filename, "\\", "/"))
+	if name == "." || name == "/" || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid file name")
+	}
+	ext := filepath.Ext(name)
+	if len(extensions) > 0 {
+		if ext = matchExtension(name, extensions); ext == "" {
+			return "", fmt.Errorf("file type not allowed")
+		}
+	}
+
+	tmp, err := os.CreateTemp(entry.Path, ".fenfa-upload-*")
+	if err != nil {
+		return "", fmt.Errorf("could not create file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	written, err := io.Copy(tmp, io.LimitReader(body, entry.MaxUploadSize+1))
+	if err == nil && written > entry.MaxUploadSize {
+		err = errUploadTooLarge
+	}
+	if err == nil {
+		err = tmp.Chmod(0640)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// A clash keeps the whole allowed extension, e.g. "backup (1).tar.gz".
+	base := strings.TrimSuffix(name, ext)
+	for i := 0; ; i++ {
+		candidate := name
+		if i > 0 {
+			candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+		}
+		err := os.Link(tmp.Name(), filepath.Join(entry.Path, candidate))
+		if err == nil {
+			return candidate, nil
+		}
+		if !os.IsExist(err) {
+			return "", fmt.Errorf("could not store file: %v", err)
+		}
+	}
+}
+
+// matchExtension returns the longest of the extensions name ends in, as
+// spelled in name, or "" when there is none. Extensions are lower case and
+// may span several dots, e.g. ".tar.gz".
+func matchExtension(name string, extensions []string) string {
+	lower := strings.ToLower(name)
+	matched := ""
+	for _, ext := range extensions {
+		if len(lower) > len(ext) && strings.HasSuffix(lower, ext) && len(ext) > len(matched) {
+			matched = ext
+		}
+	}
+	return name[len(name)-len(matched):]
+}
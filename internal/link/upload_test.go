@@ -0,0 +1,113 @@
+package link
+
+import (
+	"errors"
+	"fenfa/internal/store"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMatchExtension(t *testing.T) {
+	tests := []struct {
+		name       string
+		extensions []string
+		want       string
+	}{
+		{"report.pdf", []string{".pdf"}, ".pdf"},
+		{"REPORT.PDF", []string{".pdf"}, ".PDF"},
+		{"backup.tar.gz", []string{".tar.gz"}, ".tar.gz"},
+		{"backup.gz", []string{".tar.gz"}, ""},
+		{"backup.tar.gz", []string{".gz"}, ".gz"},
+		{"backup.tar.gz", []string{".gz", ".tar.gz"}, ".tar.gz"},
+		{"report.pdf.exe", []string{".pdf"}, ""},
+		{".pdf", []string{".pdf"}, ""},
+		{"notes.txt", []string{".pdf", ".zip"}, ""},
+	}
+	for _, tt := range tests {
+		if got := matchExtension(tt.name, tt.extensions); got != tt.want {
+			t.Errorf("matchExtension(%q, %q) = %q, want %q", tt.name, tt.extensions, got, tt.want)
+		}
+	}
+}
+
+func TestReceiveUpload(t *testing.T) {
+	tests := []struct {
+		name       string
+		filename   string
+		content    string
+		extensions []string
+		want       string // Stored name, empty when the upload is rejected
+		wantErr    error
+	}{
+		{name: "plain", filename: "report.pdf", content: "data", want: "report.pdf"},
+		{name: "path stripped", filename: "../../etc/passwd", content: "data", want: "passwd"},
+		{name: "windows path stripped", filename: `C:\Users\me\notes.txt`, content: "data", want: "notes.txt"},
+		{name: "hidden file", filename: ".bashrc", content: "data"},
+		{name: "parent directory", filename: "..", content: "data"},
+		{name: "empty name", filename: "/", content: "data"},
+		{name: "allowed extension", filename: "site.tar.gz", content: "data", extensions: []string{".tar.gz"}, want: "site.tar.gz"},
+		{name: "disallowed extension", filename: "run.sh", content: "data", extensions: []string{".tar.gz"}},
+		{name: "at size limit", filename: "full.bin", content: strings.Repeat("x", 10), want: "full.bin"},
+		{name: "over size limit", filename: "big.bin", content: strings.Repeat("x", 11), wantErr: errUploadTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			entry := store.Entry{Path: dir, MaxUploadSize: 10}
+			got, err := receiveUpload(entry, tt.extensions, tt.filename, strings.NewReader(tt.content))
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("upload of %q stored as %q, want it rejected", tt.filename, got)
+				}
+				if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+					t.Errorf("error = %v, want %v", err, tt.wantErr)
+				}
+				if files, _ := os.ReadDir(dir); len(files) != 0 {
+					t.Errorf("rejected upload left %d file(s) behind", len(files))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("upload of %q failed: %v", tt.filename, err)
+			}
+			if got != tt.want {
+				t.Errorf("stored as %q, want %q", got, tt.want)
+			}
+			if data, err := os.ReadFile(filepath.Join(dir, got)); err != nil || string(data) != tt.content {
+				t.Errorf("stored content = %q, %v, want %q", data, err, tt.content)
+			}
+		})
+	}
+}
+
+func TestReceiveUploadNeverOverwrites(t *testing.T) {
+	tests := []struct {
+		filename   string
+		extensions []string
+		want       []string // Names of successive uploads of filename
+	}{
+		{"a.txt", nil, []string{"a.txt", "a (1).txt", "a (2).txt"}},
+		{"backup.tar.gz", []string{".gz", ".tar.gz"}, []string{"backup.tar.gz", "backup (1).tar.gz", "backup (2).tar.gz"}},
+		{"README", nil, []string{"README", "README (1)"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filename, func(t *testing.T) {
+			dir := t.TempDir()
+			entry := store.Entry{Path: dir, MaxUploadSize: 100}
+			for i, name := range tt.want {
+				got, err := receiveUpload(entry, tt.extensions, tt.filename, strings.NewReader(name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != tt.want[i] {
+					t.Errorf("upload %d stored as %q, want %q", i, got, tt.want[i])
+				}
+			}
+			if data, _ := os.ReadFile(filepath.Join(dir, tt.filename)); string(data) != tt.filename {
+				t.Errorf("first upload was overwritten with %q", data)
+			}
+		})
+	}
+}
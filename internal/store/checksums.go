@@ -0,0 +1,65 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Checksums of served files are cached by path, together with the size and
+// modification time they were computed for, so a changed file is hashed
+// again. Links sharing an archive share its checksum.
+const createChecksumsSQL = `CREATE TABLE IF NOT EXISTS checksums (
+	path TEXT PRIMARY KEY,
+	size INTEGER,
+	modified INTEGER,
+	sha256 TEXT
+);`
+
+// GetChecksum returns the cached SHA-256 of the file at path, if it was
+// computed for the given size and modification time in nanoseconds.
+func GetChecksum(path string, size, modified int64) (string, bool, error) {
+	db, err := openDB()
+	if err != nil {
+		return "", false, fmt.Errorf("error opening database: %v", err)
+	}
+	defer db.Close()
+
+	var sum string
+	err = db.QueryRow(`SELECT sha256 FROM checksums WHERE path = ? AND size = ? AND modified = ?`, path, size, modified).Scan(&sum)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, fmt.Errorf("error querying checksum: %v", err)
+	}
+	return sum, true, nil
+}
+
+// SetChecksum caches the SHA-256 of the file at path.
+func SetChecksum(path string, size, modified int64, sum string) error {
+	db, err := openDB()
+	if err != nil {
+		return fmt.Errorf("error opening database: %v", err)
+	}
+	defer db.Close()
+
+	if err := executeSQL(db, `INSERT INTO checksums (path, size, modified, sha256) VALUES (?, ?, ?, ?)
+		ON CONFLICT(path) DO UPDATE SET size = excluded.size, modified = excluded.modified, sha256 = excluded.sha256`,
+		path, size, modified, sum); err != nil {
+		return fmt.Errorf("error storing checksum: %v", err)
+	}
+	return nil
+}
+
+// DeleteChecksum forgets the checksum of the file at path.
+func DeleteChecksum(path string) error {
+	db, err := openDB()
+	if err != nil {
+		return fmt.Errorf("error opening database: %v", err)
+	}
+	defer db.Close()
+
+	if err := executeSQL(db, `DELETE FROM checksums WHERE path = ?`, path); err != nil {
+		return fmt.Errorf("error deleting checksum: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Job is an archive the daemon builds in the background for a link created
+// with --async. Jobs are keyed by the hash of the link they prepare.
+type Job struct {
+	Hash       string
+	Source     string // Directory being archived
+	Status     string // One of the Job status values
+	FilesDone  int
+	FilesTotal int
+	BytesDone  int64
+	BytesTotal int64
+	Error      string
+	Created    int64
+	Updated    int64
+}
+
+// Job statuses stored in jobs.status.
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+const createJobsSQL = `CREATE TABLE IF NOT EXISTS jobs (
+	hash TEXT PRIMARY KEY,
+	source TEXT,
+	status TEXT,
+	files_done INTEGER DEFAULT 0,
+	files_total INTEGER DEFAULT 0,
+	bytes_done INTEGER DEFAULT 0,
+	bytes_total INTEGER DEFAULT 0,
+	error TEXT DEFAULT '',
+	created INTEGER,
+	updated INTEGER
+);`
+
+// jobColumns is the column list matching scanJob.
+const jobColumns = `hash, source, status, files_done, files_total, bytes_done, bytes_total, error, created, updated`
+
+func scanJob(row scanner) (Job, error) {
+	var job Job
+	err := row.Scan(&job.Hash, &job.Source, &job.Status, &job.FilesDone, &job.FilesTotal, &job.BytesDone, &job.BytesTotal,
+		&job.Error, &job.Created, &job.Updated)
+	return job, err
+}
+
+// AddJob queues a pending job for the link with the given hash.
+func AddJob(hash, source string) error {
+	db, err := openDB()
+	if err != nil {
+		return fmt.Errorf("error opening database: %v", err)
+	}
+	defer db.Close()
+
+	now := time.Now().Unix()
+	_, err = db.Exec(`INSERT INTO jobs (hash, source, status, created, updated) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(hash) DO UPDATE SET source = excluded.source, status = excluded.status, files_done = 0, files_total = 0,
+		bytes_done = 0, bytes_total = 0, error = '', created = excluded.created, updated = excluded.updated;`,
+		hash, source, JobPending, now, now)
+	if err != nil {
+		return fmt.Errorf("error inserting job: %v", err)
+	}
+	return nil
+}
+
+// NextJob marks the oldest pending job as running and returns it. ok is
+// false when no job is pending.
+func NextJob() (job Job, ok bool, err error) {
+	db, err := openDB()
+	if err != nil {
+		return Job{}, false, fmt.Errorf("error opening database: %v", err)
+	}
+	defer db.Close()
+
+	job, err = scanJob(db.QueryRow(`SELECT `+jobColumns+` FROM jobs WHERE status = ? ORDER BY created, rowid LIMIT 1`, JobPending))
+	if err == sql.ErrNoRows {
+		return Job{}, false, nil
+	} else if err != nil {
+		return Job{}, false, fmt.Errorf("error querying jobs: %v", err)
+	}
+
+	job.Status = JobRunning
+	job.Updated = time.Now().Unix()
+	if err := executeSQL(db, `UPDATE jobs SET status = ?, updated = ? WHERE hash = ?`, job.Status, job.Updated, job.Hash); err != nil {
+		return Job{}, false, fmt.Errorf("error starting job: %v", err)
+	}
+	return job, true, nil
+}
+
+// UpdateJobProgress records the progress of a running job.
+func UpdateJobProgress(job Job) error {
+	db, err := openDB()
+	if err != nil {
+		return fmt.Errorf("error opening database: %v", err)
+	}
+	defer db.Close()
+
+	err = executeSQL(db, `UPDATE jobs SET files_done = ?, files_total = ?, bytes_done = ?, bytes_total = ?, updated = ? WHERE hash = ?`,
+		job.FilesDone, job.FilesTotal, job.BytesDone, job.BytesTotal, time.Now().Unix(), job.Hash)
+	if err != nil {
+		return fmt.Errorf("error updating job: %v", err)
+	}
+	return nil
+}
+
+// FinishJob marks a job as done, or as failed with the given error message.
+func FinishJob(hash string, jobErr error) error {
+	db, err := openDB()
+	if err != nil {
+		return fmt.Errorf("error opening database: %v", err)
+	}
+	defer db.Close()
+
+	status, message := JobDone, ""
+	if jobErr != nil {
+		status, message = JobFailed, jobErr.Error()
+	}
+	if err := executeSQL(db, `UPDATE jobs SET status = ?, error = ?, updated = ? WHERE hash = ?`,
+		status, message, time.Now().Unix(), hash); err != nil {
+		return fmt.Errorf("error finishing job: %v", err)
+	}
+	return nil
+}
+
+// RequeueRunningJobs marks jobs left running by a stopped daemon as pending
+// so they are started again.
+func RequeueRunningJobs() error {
+	db, err := openDB()
+	if err != nil {
+		return fmt.Errorf("error opening database: %v", err)
+	}
+	defer db.Close()
+
+	if err := executeSQL(db, `UPDATE jobs SET status = ?, files_done = 0, bytes_done = 0 WHERE status = ?`, JobPending, JobRunning); err != nil {
+		return fmt.Errorf("error requeueing jobs: %v", err)
+	}
+	return nil
+}
+
+// GetJob returns the job preparing the link with the given hash.
+func GetJob(hash string) (Job, bool, error) {
+	db, err := openDB()
+	if err != nil {
+		return Job{}, false, fmt.Errorf("error opening database: %v", err)
+	}
+	defer db.Close()
+
+	job, err := scanJob(db.QueryRow(`SELECT `+jobColumns+` FROM jobs WHERE hash = ?`, hash))
+	if err == sql.ErrNoRows {
+		return Job{}, false, nil
+	} else if err != nil {
+		return Job{}, false, fmt.Errorf("error querying job: %v", err)
+	}
+	return job, true, nil
+}
+
+// ListJobs returns every job, oldest first.
+func ListJobs() ([]Job, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %v", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT ` + jobColumns + ` FROM jobs ORDER BY created, rowid`)
+	if err != nil {
+		return nil, fmt.Errorf("error querying jobs: %v", err)
+	}
+	defer rows.Close()
+
+	var jobs []Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning job: %v", err)
+		}
+		jobs = append(jobs, job)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during row iteration: %v", err)
+	}
+	return jobs, nil
+}
+
+// DeleteJob removes the job for the link with the given hash.
+func DeleteJob(hash string) error {
+	db, err := openDB()
+	if err != nil {
+		return fmt.Errorf("error opening database: %v", err)
+	}
+	defer db.Close()
+
+	return executeSQL(db, `DELETE FROM jobs WHERE hash = ?`, hash)
+}
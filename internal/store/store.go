@@ -5,7 +5,7 @@ import (
 	"fenfa/internal/config"
 	"fmt"
 	"log"
-	"os"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -14,40 +14,157 @@ import (
 var dbPath string
 
 type Entry struct {
-	Expiration int64  `json:"expiration"`
-	Path       string `json:"path"`
+	Hash          string `json:"hash"`
+	Expiration    int64  `json:"expiration"`
+	Path          string `json:"path"`
+	Source        string `json:"source"`        // Path the link was created for, e.g. a zipped directory
+	MaxDownloads  int    `json:"max_downloads"` // 0 means unlimited
+	DownloadCount int    `json:"download_count"`
+	PasswordHash  string `json:"-"` // bcrypt hash, empty when no password is required
+	Mode          string `json:"mode"`
+
+	MaxUploadSize     int64  `json:"max_upload_size"`    // Per-file limit for upload links
+	AllowedExtensions string `json:"allowed_extensions"` // Comma separated, empty allows all
+
+	ArchiveOptions string `json:"archive_options"` // JSON encoded options for directory links
+	Status         string `json:"status"`          // One of the Status values
+	Filename       string `json:"filename"`        // Name downloads are offered under, empty for the name of Source
+	Landing        string `json:"landing"`         // One of the Landing values
 }
 
+// entryColumns is the column list matching scanEntry.
+const entryColumns = `hash, expiration, path, source, max_downloads, download_count, password_hash, mode,
+	max_upload_size, allowed_extensions, archive_options, status, filename, landing`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanEntry(row scanner) (Entry, error) {
+	var entry Entry
+	err := row.Scan(&entry.Hash, &entry.Expiration, &entry.Path, &entry.Source, &entry.MaxDownloads, &entry.DownloadCount, &entry.PasswordHash, &entry.Mode,
+		&entry.MaxUploadSize, &entry.AllowedExtensions, &entry.ArchiveOptions, &entry.Status, &entry.Filename, &entry.Landing)
+	return entry, err
+}
+
+// DownloadsExhausted reports whether the entry has used up its download quota.
+func (e Entry) DownloadsExhausted() bool {
+	return e.MaxDownloads > 0 && e.DownloadCount >= e.MaxDownloads
+}
+
+// entryMigrations lists columns added to the entries table after its
+// initial schema. Missing columns are added when the store is initialized.
+var entryMigrations = []struct {
+	column     string
+	definition string
+}{
+	{"max_downloads", "INTEGER DEFAULT 0"},
+	{"download_count", "INTEGER DEFAULT 0"},
+	{"source", "TEXT DEFAULT ''"},
+	{"password_hash", "TEXT DEFAULT ''"},
+	{"mode", "TEXT DEFAULT 'file'"},
+	{"max_upload_size", "INTEGER DEFAULT 0"},
+	{"allowed_extensions", "TEXT DEFAULT ''"},
+	{"archive_options", "TEXT DEFAULT ''"},
+	{"status", "TEXT DEFAULT 'ready'"},
+	{"filename", "TEXT DEFAULT ''"},
+	{"landing", "TEXT DEFAULT ''"},
+}
+
+// Link modes stored in entries.mode.
+const (
+	ModeFile   = "file"   // Serve a single file or pre-built archive
+	ModeBrowse = "browse" // Serve an index of a directory tree
+	ModeUpload = "upload" // Accept uploads into a directory
+	ModeLive   = "live"   // Stream an archive of a directory built at download time
+	ModeE2E    = "e2e"    // Serve ciphertext decrypted in the recipient's browser
+)
+
+// Link statuses stored in entries.status.
+const (
+	StatusReady     = "ready"     // The link can be downloaded
+	StatusPreparing = "preparing" // The daemon is still building the archive
+	StatusFailed    = "failed"    // Building the archive failed, see the job
+)
+
+// Landing page settings stored in entries.landing.
+const (
+	LandingDefault = ""       // Follow FENFA_LANDING_PAGE
+	LandingPage    = "page"   // Show a landing page before the download
+	LandingDirect  = "direct" // Start the download right away
+)
+
 func Initialize() {
 	dbPath = config.BinaryDirectory + `/data.db`
-	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
-		db, err := openDB()
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer db.Close()
-
-		createEntriesSQL := `CREATE TABLE entries (
-			hash TEXT PRIMARY KEY,
-			expiration INTEGER,
-			path TEXT
-		);`
-		if err := executeSQL(db, createEntriesSQL); err != nil {
-			log.Fatal(err)
+	db, err := openDB()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	createEntriesSQL := `CREATE TABLE IF NOT EXISTS entries (
+		hash TEXT PRIMARY KEY,
+		expiration INTEGER,
+		path TEXT
+	);`
+	if err := executeSQL(db, createEntriesSQL); err != nil {
+		log.Fatal(err)
+	}
+
+	createIPAttemptsSQL := `CREATE TABLE IF NOT EXISTS ip_attempts (
+		ip_address TEXT PRIMARY KEY,
+		failed_attempts INTEGER DEFAULT 0
+	);`
+	if err := executeSQL(db, createIPAttemptsSQL); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := executeSQL(db, createJobsSQL); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := executeSQL(db, createChecksumsSQL); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := migrateEntries(db); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func migrateEntries(db *sql.DB) error {
+	rows, err := db.Query(`PRAGMA table_info(entries)`)
+	if err != nil {
+		return fmt.Errorf("error reading entries schema: %v", err)
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning entries schema: %v", err)
 		}
+		existing[name] = true
+	}
+	rows.Close()
 
-		createIPAttemptsSQL := `CREATE TABLE ip_attempts (
-			ip_address TEXT PRIMARY KEY,
-			failed_attempts INTEGER DEFAULT 0
-		);`
-		if err := executeSQL(db, createIPAttemptsSQL); err != nil {
-			log.Fatal(err)
+	for _, m := range entryMigrations {
+		if existing[m.column] {
+			continue
+		}
+		if err := executeSQL(db, fmt.Sprintf(`ALTER TABLE entries ADD COLUMN %s %s`, m.column, m.definition)); err != nil {
+			return fmt.Errorf("error adding column %s: %v", m.column, err)
 		}
 	}
+	return nil
 }
 
 func openDB() (*sql.DB, error) {
-	return sql.Open("sqlite3", dbPath)
+	// Concurrent requests write to the database, e.g. to claim downloads,
+	// so writers wait for each other instead of failing.
+	return sql.Open("sqlite3", dbPath+"?_busy_timeout=5000")
 }
 
 func executeSQL(db *sql.DB, sqlStatement string, args ...interface{}) error {
@@ -63,10 +180,8 @@ func Get(hash string) (record Entry, active bool, exists bool) {
 	}
 	defer db.Close()
 
-	var entry Entry
-
-	query := `SELECT expiration, path FROM entries WHERE hash = ?`
-	err = db.QueryRow(query, hash).Scan(&entry.Expiration, &entry.Path)
+	query := `SELECT ` + entryColumns + ` FROM entries WHERE hash = ?`
+	entry, err := scanEntry(db.QueryRow(query, hash))
 
 	if err == sql.ErrNoRows {
 		return Entry{}, false, false
@@ -83,15 +198,29 @@ func Get(hash string) (record Entry, active bool, exists bool) {
 	return entry, true, true
 }
 
-func Add(hash string, expiration int64, path string) error {
+func Add(entry Entry) error {
 	db, err := openDB()
 	if err != nil {
 		return fmt.Errorf("error opening database: %v", err)
 	}
 	defer db.Close()
 
-	_, err = db.Exec(`INSERT INTO entries (hash, expiration, path) VALUES (?, ?, ?) 
-		ON CONFLICT(hash) DO UPDATE SET expiration = excluded.expiration, path = excluded.path;`, hash, expiration, path)
+	if entry.Mode == "" {
+		entry.Mode = ModeFile
+	}
+	if entry.Status == "" {
+		entry.Status = StatusReady
+	}
+
+	_, err = db.Exec(`INSERT INTO entries (hash, expiration, path, source, max_downloads, download_count, password_hash, mode,
+			max_upload_size, allowed_extensions, archive_options, status, filename, landing) VALUES (?, ?, ?, ?, ?, 0, ?, ?, ?, ?, ?, ?, ?, ?) 
+		ON CONFLICT(hash) DO UPDATE SET expiration = excluded.expiration, path = excluded.path, source = excluded.source,
+		max_downloads = excluded.max_downloads, download_count = 0, password_hash = excluded.password_hash, mode = excluded.mode,
+		max_upload_size = excluded.max_upload_size, allowed_extensions = excluded.allowed_extensions,
+		archive_options = excluded.archive_options, status = excluded.status, filename = excluded.filename,
+		landing = excluded.landing;`,
+		entry.Hash, entry.Expiration, entry.Path, entry.Source, entry.MaxDownloads, entry.PasswordHash, entry.Mode,
+		entry.MaxUploadSize, entry.AllowedExtensions, entry.ArchiveOptions, entry.Status, entry.Filename, entry.Landing)
 
 	if err != nil {
 		return fmt.Errorf("error inserting/updating entry: %v", err)
@@ -100,6 +229,79 @@ func Add(hash string, expiration int64, path string) error {
 	return nil
 }
 
+// ClaimDownload reserves one download of the entry before it is served,
+// reporting false when its download limit is used up. The check and the
+// increment are a single statement, so concurrent requests cannot claim
+// more downloads than the limit allows.
+func ClaimDownload(hash string) (bool, error) {
+	db, err := openDB()
+	if err != nil {
+		return false, fmt.Errorf("error opening database: %v", err)
+	}
+	defer db.Close()
+
+	result, err := db.Exec(`UPDATE entries SET download_count = download_count + 1
+		WHERE hash = ? AND (max_downloads = 0 OR download_count < max_downloads)`, hash)
+	if err != nil {
+		return false, fmt.Errorf("error claiming download: %v", err)
+	}
+	claimed, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("error claiming download: %v", err)
+	}
+	return claimed > 0, nil
+}
+
+// ReleaseDownload gives back a download claimed with ClaimDownload whose
+// transfer did not complete.
+func ReleaseDownload(hash string) error {
+	db, err := openDB()
+	if err != nil {
+		return fmt.Errorf("error opening database: %v", err)
+	}
+	defer db.Close()
+
+	if err := executeSQL(db, `UPDATE entries SET download_count = download_count - 1 WHERE hash = ? AND download_count > 0`, hash); err != nil {
+		return fmt.Errorf("error releasing download: %v", err)
+	}
+	return nil
+}
+
+// SetExpiration updates the expiration of an existing entry.
+func SetExpiration(hash string, expiration int64) error {
+	db, err := openDB()
+	if err != nil {
+		return fmt.Errorf("error opening database: %v", err)
+	}
+	defer db.Close()
+
+	if err := executeSQL(db, `UPDATE entries SET expiration = ? WHERE hash = ?`, expiration, hash); err != nil {
+		return fmt.Errorf("error updating expiration: %v", err)
+	}
+	return nil
+}
+
+// SetStatus updates the status of an entry, and its served path when path is
+// not empty. It reports whether the entry still exists.
+func SetStatus(hash, status, path string) (bool, error) {
+	db, err := openDB()
+	if err != nil {
+		return false, fmt.Errorf("error opening database: %v", err)
+	}
+	defer db.Close()
+
+	result, err := db.Exec(`UPDATE entries SET status = ?, path = CASE WHEN ? = '' THEN path ELSE ? END WHERE hash = ?`,
+		status, path, path, hash)
+	if err != nil {
+		return false, fmt.Errorf("error updating status: %v", err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("error updating status: %v", err)
+	}
+	return updated > 0, nil
+}
+
 func Delete(hash string) error {
 	db, err := openDB()
 	if err != nil {
@@ -110,6 +312,87 @@ func Delete(hash string) error {
 	return executeSQL(db, `DELETE FROM entries WHERE hash = ?`, hash)
 }
 
+func queryEntries(query string, args ...interface{}) ([]Entry, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %v", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying entries: %v", err)
+	}
+	defer rows.Close()
+
+	var entries []Entry
+	for rows.Next() {
+		entry, err := scanEntry(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning entry: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error during row iteration: %v", err)
+	}
+	return entries, nil
+}
+
+// Find returns the entries whose hash, served path or source path matches target.
+func Find(target string) ([]Entry, error) {
+	return queryEntries(`SELECT `+entryColumns+` FROM entries WHERE hash = ? OR path = ? OR source = ?`, target, target, target)
+}
+
+// FindExpired returns the entries that expired at or before the given time.
+func FindExpired(before int64) ([]Entry, error) {
+	return queryEntries(`SELECT `+entryColumns+` FROM entries WHERE expiration <= ?`, before)
+}
+
+// FindByPathPrefix returns the entries whose served or source path is prefix
+// or lies below it.
+func FindByPathPrefix(prefix string) ([]Entry, error) {
+	dir := strings.TrimSuffix(prefix, "/") + "/"
+	pattern := likeEscaper.Replace(dir) + "%"
+	entries, err := queryEntries(`SELECT `+entryColumns+` FROM entries
+		WHERE path = ? OR source = ? OR path LIKE ? ESCAPE '\' OR source LIKE ? ESCAPE '\'`,
+		prefix, prefix, pattern, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	// LIKE ignores the case of ASCII letters, so matches are narrowed down
+	// to those under the exact prefix.
+	var found []Entry
+	for _, entry := range entries {
+		if entry.Path == prefix || entry.Source == prefix ||
+			strings.HasPrefix(entry.Path, dir) || strings.HasPrefix(entry.Source, dir) {
+			found = append(found, entry)
+		}
+	}
+	return found, nil
+}
+
+// likeEscaper escapes the wildcards of a LIKE pattern, with a backslash as
+// the escape character.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// CountByPath returns the number of entries serving the given path.
+func CountByPath(path string) (int, error) {
+	db, err := openDB()
+	if err != nil {
+		return 0, fmt.Errorf("error opening database: %v", err)
+	}
+	defer db.Close()
+
+	var count int
+	err = db.QueryRow(`SELECT COUNT(*) FROM entries WHERE path = ?`, path).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("error counting entries: %v", err)
+	}
+	return count, nil
+}
+
 func List(table string) error {
 	db, err := openDB()
 	if err != nil {
@@ -117,7 +400,15 @@ func List(table string) error {
 	}
 	defer db.Close()
 
-	query := fmt.Sprintf(`SELECT * FROM %s`, table)
+	var query string
+	switch table {
+	case "entries":
+		query = `SELECT ` + entryColumns + ` FROM entries`
+	case "ip_attempts":
+		query = `SELECT ip_address, failed_attempts FROM ip_attempts`
+	default:
+		return fmt.Errorf("unknown table %s", table)
+	}
 	rows, err := db.Query(query)
 	if err != nil {
 		return fmt.Errorf("error querying table %s: %v", table, err)
@@ -127,12 +418,23 @@ func List(table string) error {
 	if table == "entries" {
 		fmt.Println("Active Share Links:")
 		for rows.Next() {
-			var hash string
-			var entry Entry
-			if err := rows.Scan(&hash, &entry.Expiration, &entry.Path); err != nil {
+			entry, err := scanEntry(rows)
+			if err != nil {
 				return fmt.Errorf("error scanning entry: %v", err)
 			}
-			fmt.Printf("Path: %s, Expiration: %d, Hash: %s\n", entry.Path, entry.Expiration, hash)
+			downloads := fmt.Sprintf("%d", entry.DownloadCount)
+			if entry.MaxDownloads > 0 {
+				downloads = fmt.Sprintf("%d/%d", entry.DownloadCount, entry.MaxDownloads)
+			}
+			protected := ""
+			if entry.PasswordHash != "" {
+				protected = ", Password: yes"
+			}
+			status := ""
+			if entry.Status != StatusReady {
+				status = ", Status: " + entry.Status
+			}
+			fmt.Printf("Path: %s, Mode: %s, Expiration: %d, Downloads: %s%s%s, Hash: %s\n", entry.Path, entry.Mode, entry.Expiration, downloads, protected, status, entry.Hash)
 		}
 	} else if table == "ip_attempts" {
 		fmt.Println("IP Attempt Records:")
@@ -0,0 +1,149 @@
+package store
+
+import (
+	"fenfa/internal/config"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// setupStore initializes a database in a temporary directory.
+func setupStore(t *testing.T) {
+	t.Helper()
+	config.BinaryDirectory = t.TempDir()
+	Initialize()
+}
+
+func TestClaimDownload(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxDownloads int
+		requests     int
+		want         int
+	}{
+		{"single download", 1, 20, 1},
+		{"limited", 3, 20, 3},
+		{"unlimited", 0, 20, 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupStore(t)
+			hash := "hash-" + tt.name
+			err := Add(Entry{Hash: hash, Expiration: time.Now().Add(time.Hour).Unix(), Path: "/tmp/file", MaxDownloads: tt.maxDownloads})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			claimed := 0
+			for i := 0; i < tt.requests; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					ok, err := ClaimDownload(hash)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if ok {
+						mu.Lock()
+						claimed++
+						mu.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+			if claimed != tt.want {
+				t.Errorf("claimed %d downloads, want %d", claimed, tt.want)
+			}
+		})
+	}
+}
+
+func TestReleaseDownload(t *testing.T) {
+	setupStore(t)
+	hash := "hash"
+	if err := Add(Entry{Hash: hash, Expiration: time.Now().Add(time.Hour).Unix(), Path: "/tmp/file", MaxDownloads: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		action string
+		want   bool
+	}{
+		{"claim", true},
+		{"claim", false},
+		{"release", true},
+		{"claim", true},
+		{"claim", false},
+	}
+	for i, step := range steps {
+		if step.action == "release" {
+			if err := ReleaseDownload(hash); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		ok, err := ClaimDownload(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != step.want {
+			t.Errorf("step %d: claim = %v, want %v", i, ok, step.want)
+		}
+	}
+	entry, _, _ := Get(hash)
+	if !entry.DownloadsExhausted() {
+		t.Errorf("entry with %d of %d downloads is not exhausted", entry.DownloadCount, entry.MaxDownloads)
+	}
+}
+
+func TestFindByPathPrefix(t *testing.T) {
+	setupStore(t)
+	paths := []string{
+		"/srv/données",
+		"/srv/données/a.txt",
+		"/srv/données/sub/b.txt",
+		"/srv/donnéesX/c.txt",
+		"/srv/DONNÉES/d.txt",
+		"/srv/a_b/e.txt",
+		"/srv/axb/f.txt",
+		"/srv/100%/g.txt",
+		"/srv/1000/h.txt",
+	}
+	for i, path := range paths {
+		err := Add(Entry{Hash: fmt.Sprintf("hash-%d", i), Expiration: time.Now().Add(time.Hour).Unix(), Path: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"/srv/données", []string{"/srv/données", "/srv/données/a.txt", "/srv/données/sub/b.txt"}},
+		{"/srv/données/", []string{"/srv/données/a.txt", "/srv/données/sub/b.txt"}},
+		{"/srv/a_b", []string{"/srv/a_b/e.txt"}},
+		{"/srv/100%", []string{"/srv/100%/g.txt"}},
+		{"/srv/none", nil},
+	}
+	for _, tt := range tests {
+		entries, err := FindByPathPrefix(tt.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, entry := range entries {
+			got = append(got, entry.Path)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("FindByPathPrefix(%q) = %q, want %q", tt.prefix, got, tt.want)
+		}
+	}
+}
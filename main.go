@@ -5,11 +5,14 @@ import (
 	"fenfa/internal/config"
 	"fenfa/internal/link"
 	"fenfa/internal/store"
+	"fenfa/pkg/utils"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -26,12 +29,19 @@ const (
 	CommandLink      = "link"
 	CommandList      = "list"
 	CommandUnban     = "unban"
+	CommandRevoke    = "revoke"
+	CommandExtend    = "extend"
+	CommandRequest   = "request"
+	CommandJobs      = "jobs"
 )
 
+const Usage = "Usage: fenfa [start|stop|force-quit|list [entries|ip_attempts]|link [options] /path/to/file|request [options] /path/to/directory|revoke [options] [hash|path]|extend hash duration|timestamp|jobs|unban IP]"
+
 var (
 	requests        int
 	mu              sync.Mutex
 	windowDuration  = time.Minute
+	jobPollInterval = 2 * time.Second
 	signalFlag      = new(string)
 	httpServer      *http.Server
 	binaryDirectory string
@@ -55,7 +65,7 @@ func main() {
 	log.SetOutput(logFile)
 
 	if len(os.Args) < 2 {
-		fmt.Println("No command provided. Usage: fenfa [start|stop|force-quit|list [entries|ip_attempts]|link /path/to/file]")
+		fmt.Println("No command provided. " + Usage)
 		os.Exit(1)
 	}
 
@@ -79,25 +89,42 @@ func main() {
 		*signalFlag = CommandForceQuit
 		sendFlag(cntxt)
 	case CommandLink:
-		if len(os.Args) < 3 {
-			fmt.Println("No path provided. Usage: fenfa link /path/to/file]")
-			os.Exit(1)
+		path, opts := parseLinkArgs(os.Args[2:])
+		if opts.Async && !opts.DryRun && !opts.Quiet && !daemonRunning() {
+			fmt.Fprintln(os.Stderr, "Warning: the daemon is not running, the archive will be prepared once fenfa start is run.")
 		}
-		link.GenerateFileLink(os.Args[2])
+		link.GenerateFileLink(path, opts)
 	case CommandList:
 		if len(os.Args) < 3 {
 			fmt.Println("No table provided. Usage: fenfa link [entries|ip_entries]")
 			os.Exit(1)
 		}
-		store.List(os.Args[2])
+		if err := store.List(os.Args[2]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
 	case CommandUnban:
 		if len(os.Args) < 3 {
 			fmt.Println("No IP provided. Usage: fenfa unban [IP Address]")
 			os.Exit(1)
 		}
 		store.ResetFailedAttempts(os.Args[2])
+	case CommandRequest:
+		dir, opts := parseRequestArgs(os.Args[2:])
+		link.CreateUploadLink(dir, opts)
+	case CommandExtend:
+		if len(os.Args) < 4 {
+			fmt.Println("Missing arguments. Usage: fenfa extend hash [duration|timestamp]")
+			os.Exit(1)
+		}
+		link.ExtendLink(os.Args[2], os.Args[3])
+	case CommandRevoke:
+		link.RevokeLinks(parseRevokeArgs(os.Args[2:]))
+	case CommandJobs:
+		if err := link.ListJobs(); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
 	default:
-		fmt.Println("Invalid command. Usage: fenfa [start|stop|list [entries|ip_attempts]|link /path/to/file]")
+		fmt.Println("Invalid command. " + Usage)
 	}
 
 	switch command {
@@ -106,7 +133,288 @@ func main() {
 	}
 }
 
+func parseLinkArgs(args []string) (string, link.Options) {
+	var opts link.Options
+	fs := flag.NewFlagSet(CommandLink, flag.ExitOnError)
+	shared := addSharedLinkFlags(fs)
+	fs.IntVar(&opts.MaxDownloads, "max-downloads", 0, "number of completed downloads allowed (0 for unlimited)")
+	fs.BoolVar(&opts.Browse, "browse", false, "serve a directory as a browsable index instead of a zip")
+	fs.BoolVar(&opts.Live, "live", false, "stream an archive of a directory built at download time instead of archiving it now")
+	fs.StringVar(&opts.Format, "format", utils.FormatZip, "archive format for directories: zip, tar.gz or tar.zst")
+	fs.Var((*stringList)(&opts.Include), "include", "only share files matching this glob (repeatable)")
+	fs.Var((*stringList)(&opts.Exclude), "exclude", "leave out files and directories matching this glob (repeatable)")
+	fs.BoolVar(&opts.GitIgnore, "gitignore", false, "honor .gitignore files when sharing directories")
+	fs.BoolVar(&opts.Deterministic, "deterministic", false, "normalize timestamps and permissions for reproducible archives")
+	fs.BoolVar(&opts.StoreOnly, "store-only", false, "store files in zip archives without compression")
+	encrypt := fs.Bool("encrypt-archive", false, "encrypt the zip archive of a directory with AES-256 and a generated passphrase")
+	promptPassphrase := fs.Bool("prompt-passphrase", false, "prompt for the --encrypt-archive passphrase instead of generating one")
+	fs.StringVar(&opts.Filename, "filename", "", "name the download is saved under (default the name of the shared file, or the directory name plus the archive extension)")
+	landing := fs.Bool("landing", false, "show a landing page with the file details before the download (default FENFA_LANDING_PAGE)")
+	direct := fs.Bool("direct", false, "start the download right away, without a landing page")
+	fs.BoolVar(&opts.E2E, "e2e", false, "encrypt end to end with a key in the link that the server never sees")
+	fs.StringVar(&opts.Symlinks, "symlinks", "", "symlink policy: follow, skip, preserve-as-link or follow-within-root (default FENFA_SYMLINK_POLICY, else preserve-as-link for tarballs and follow-within-root for zips)")
+	maxDepth := fs.Int("max-depth", 0, "directory levels to include, 0 for the top level only, -1 for unlimited (default FENFA_MAX_ZIP_DEPTH)")
+	fs.BoolVar(&opts.Strict, "strict", false, "refuse to share a directory when any file would be left out")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "report what would be shared without creating the link")
+	fs.BoolVar(&opts.Quiet, "quiet", false, "print only the URL, without warnings or progress")
+	fs.BoolVar(&opts.Async, "async", false, "create the link now and let the daemon build the archive, see fenfa jobs")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: fenfa link [options] /path/to/file")
+		fs.PrintDefaults()
+	}
+
+	positional := parseInterspersed(fs, args)
+	if len(positional) != 1 {
+		fmt.Println("No path provided. Usage: fenfa link [options] /path/to/file")
+		os.Exit(1)
+	}
+
+	if opts.MaxDownloads < 0 {
+		fmt.Println("Error: --max-downloads cannot be negative")
+		os.Exit(1)
+	}
+	// 0 is a valid depth, so only a --max-depth actually given overrides
+	// FENFA_MAX_ZIP_DEPTH.
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "max-depth" {
+			opts.MaxDepth = maxDepth
+		}
+	})
+	if opts.MaxDepth != nil && *opts.MaxDepth < -1 {
+		fmt.Println("Error: --max-depth must be 0 or more, or -1 for unlimited")
+		os.Exit(1)
+	}
+	if opts.Filename != "" {
+		if err := utils.ValidateFilename(opts.Filename); err != nil {
+			fmt.Printf("Error: invalid --filename: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if !utils.ValidFormat(opts.Format) {
+		fmt.Printf("Error: unsupported --format %q, use zip, tar.gz or tar.zst\n", opts.Format)
+		os.Exit(1)
+	}
+	if opts.Symlinks != "" && !utils.ValidSymlinkPolicy(opts.Symlinks) {
+		fmt.Printf("Error: unsupported --symlinks %q\n", opts.Symlinks)
+		os.Exit(1)
+	}
+	for _, pattern := range append(opts.Include, opts.Exclude...) {
+		if err := utils.ValidatePattern(pattern); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if opts.Browse && opts.Live {
+		fmt.Println("Error: --browse and --live cannot be used together")
+		os.Exit(1)
+	}
+	if opts.Async && (opts.Browse || opts.Live) {
+		fmt.Println("Error: --async cannot be used with --browse or --live")
+		os.Exit(1)
+	}
+	if opts.E2E && (opts.Browse || opts.Live || opts.Async || *encrypt) {
+		fmt.Println("Error: --e2e cannot be used with --browse, --live, --async or --encrypt-archive")
+		os.Exit(1)
+	}
+	if *landing || *direct {
+		if *landing && *direct {
+			fmt.Println("Error: --landing and --direct cannot be used together")
+			os.Exit(1)
+		}
+		if opts.Browse || opts.E2E {
+			fmt.Println("Error: --landing and --direct cannot be used with --browse or --e2e")
+			os.Exit(1)
+		}
+		opts.Landing = store.LandingDirect
+		if *landing {
+			opts.Landing = store.LandingPage
+		}
+	}
+	if *promptPassphrase && !*encrypt {
+		fmt.Println("Error: --prompt-passphrase requires --encrypt-archive")
+		os.Exit(1)
+	}
+	if *encrypt {
+		if opts.Browse || opts.Live || opts.Async {
+			fmt.Println("Error: --encrypt-archive cannot be used with --browse, --live or --async")
+			os.Exit(1)
+		}
+		if opts.Format != utils.FormatZip {
+			fmt.Println("Error: --encrypt-archive requires --format zip")
+			os.Exit(1)
+		}
+		opts.EncryptArchive = true
+	}
+	// A dry run creates no archive, so there is no passphrase to ask for or
+	// generate.
+	if *encrypt && !opts.DryRun {
+		if *promptPassphrase {
+			p, err := utils.PromptPassword("Archive passphrase: ")
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			opts.Passphrase = p
+		} else {
+			p, err := utils.GeneratePassphrase()
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			opts.Passphrase = p
+			opts.ShowPassphrase = true
+		}
+	}
+	shared.apply(&opts)
+
+	return positional[0], opts
+}
+
+func parseRequestArgs(args []string) (string, link.Options) {
+	var opts link.Options
+	fs := flag.NewFlagSet(CommandRequest, flag.ExitOnError)
+	shared := addSharedLinkFlags(fs)
+	maxSize := fs.String("max-size", "", "maximum size of each uploaded file, e.g. 500MB (default FENFA_MAX_UPLOAD_SIZE)")
+	allowExt := fs.String("allow-ext", "", "comma separated list of accepted extensions, e.g. .pdf,.zip")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: fenfa request [options] /path/to/directory")
+		fs.PrintDefaults()
+	}
+
+	positional := parseInterspersed(fs, args)
+	if len(positional) != 1 {
+		fmt.Println("No directory provided. Usage: fenfa request [options] /path/to/directory")
+		os.Exit(1)
+	}
+
+	if *maxSize != "" {
+		size, err := utils.ParseBytes(*maxSize)
+		if err != nil || size <= 0 {
+			fmt.Printf("Error: invalid --max-size value %q\n", *maxSize)
+			os.Exit(1)
+		}
+		opts.MaxUploadSize = size
+	}
+	if *allowExt != "" {
+		opts.AllowedExtensions = strings.Split(*allowExt, ",")
+	}
+	shared.apply(&opts)
+
+	return positional[0], opts
+}
+
+// sharedLinkFlags holds the options accepted by both link and request.
+type sharedLinkFlags struct {
+	expires  *string
+	until    *string
+	password *bool
+}
+
+func addSharedLinkFlags(fs *flag.FlagSet) sharedLinkFlags {
+	return sharedLinkFlags{
+		expires:  fs.String("expires", "", "relative link lifetime, e.g. 2h, 7d"),
+		until:    fs.String("until", "", "absolute expiration, e.g. 2026-11-01T17:00"),
+		password: fs.Bool("password", false, "prompt for a password recipients must enter"),
+	}
+}
+
+// apply validates the shared flags and stores them in opts, exiting on
+// invalid values.
+func (f sharedLinkFlags) apply(opts *link.Options) {
+	if *f.expires != "" && *f.until != "" {
+		fmt.Println("Error: --expires and --until cannot be used together")
+		os.Exit(1)
+	}
+	if *f.expires != "" {
+		d, err := utils.ParseDuration(*f.expires)
+		if err != nil || d <= 0 {
+			fmt.Printf("Error: invalid --expires value %q\n", *f.expires)
+			os.Exit(1)
+		}
+		opts.Expires = d
+	}
+	if *f.until != "" {
+		t, err := utils.ParseTimestamp(*f.until)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if !t.After(time.Now()) {
+			fmt.Printf("Error: --until %s is in the past\n", *f.until)
+			os.Exit(1)
+		}
+		opts.Until = t
+	}
+
+	// A dry run creates no link, so there is no password to ask for.
+	if *f.password && !opts.DryRun {
+		p, err := utils.PromptPassword("Link password: ")
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		opts.Password = p
+	}
+}
+
+func parseRevokeArgs(args []string) link.RevokeOptions {
+	var opts link.RevokeOptions
+	fs := flag.NewFlagSet(CommandRevoke, flag.ExitOnError)
+	fs.BoolVar(&opts.AllExpired, "all-expired", false, "revoke every expired link")
+	fs.StringVar(&opts.PathPrefix, "path-prefix", "", "revoke every link at or below this path")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: fenfa revoke [--all-expired] [--path-prefix /path] [hash|path]")
+		fs.PrintDefaults()
+	}
+
+	positional := parseInterspersed(fs, args)
+	if len(positional) > 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if len(positional) == 1 {
+		opts.Target = positional[0]
+	}
+	if opts.Target == "" && !opts.AllExpired && opts.PathPrefix == "" {
+		fmt.Println("Nothing to revoke. Usage: fenfa revoke [--all-expired] [--path-prefix /path] [hash|path]")
+		os.Exit(1)
+	}
+	return opts
+}
+
+// stringList is a flag.Value collecting every occurrence of a repeatable flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// parseInterspersed parses flags that may appear before or after positional
+// arguments, e.g. "fenfa link file --expires 2h", and returns the positionals.
+func parseInterspersed(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
 func startServer(cntxt *daemon.Context) {
+	// Checked before the daemon starts so template errors reach the terminal.
+	if err := link.LoadTemplates(config.TemplateDir); err != nil {
+		log.Fatalf("Error loading templates: %v", err)
+	}
+
 	d, err := cntxt.Search()
 	if err == nil && d != nil {
 		log.Println("Server is already running.")
@@ -123,15 +431,17 @@ func startServer(cntxt *daemon.Context) {
 	log.Println("Started Daemon")
 	defer cntxt.Release()
 	go resetRateLimit()
+	go runJanitor()
+	go runJobs()
 	httpServer = &http.Server{
 		Addr: fmt.Sprintf(":%d", config.Port),
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if r.Method != http.MethodGet {
-				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			if r.Method != http.MethodGet && r.Method != http.MethodPost {
+				link.ServeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
 				return
 			}
 			if !rateLimit() {
-				http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+				link.ServeError(w, r, http.StatusTooManyRequests, "Rate limit exceeded")
 				return
 			}
 			link.FileHandler(w, r)
@@ -213,3 +523,38 @@ func resetRateLimit() {
 		mu.Unlock()
 	}
 }
+
+func runJobs() {
+	if err := store.RequeueRunningJobs(); err != nil {
+		log.Printf("Jobs: %v", err)
+	}
+	for {
+		link.RunJobs()
+		time.Sleep(jobPollInterval)
+	}
+}
+
+// daemonRunning reports whether the daemon's PID file names a live process.
+func daemonRunning() bool {
+	pid, err := daemon.ReadPidFile(filepath.Join(binaryDirectory, PIDFileName))
+	if err != nil {
+		return false
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return process.Signal(syscall.Signal(0)) == nil
+}
+
+func runJanitor() {
+	interval := time.Duration(config.JanitorInterval) * time.Second
+	if interval <= 0 {
+		log.Println("Janitor disabled.")
+		return
+	}
+	for {
+		link.PurgeExpired()
+		time.Sleep(interval)
+	}
+}
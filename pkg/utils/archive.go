@@ -0,0 +1,409 @@
+package utils
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Archive formats supported by WriteArchive.
+const (
+	FormatZip    = "zip"
+	FormatTarGz  = "tar.gz"
+	FormatTarZst = "tar.zst"
+)
+
+// ArchiveOptions controls how a directory is archived. It is stored with a
+// link so archives built at download time follow the same rules.
+type ArchiveOptions struct {
+	Format    string   `json:"format"`
+	MaxDepth  int      `json:"max_depth"`         // Subdirectory levels to include, 0 for the top level only, negative for unlimited
+	Include   []string `json:"include,omitempty"` // Patterns files must match, all files when empty
+	Exclude   []string `json:"exclude,omitempty"` // Patterns of files and directories to leave out
+	GitIgnore bool     `json:"gitignore,omitempty"`
+	Symlinks  string   `json:"symlinks"` // One of the Symlink policies, DefaultSymlinkPolicy when empty
+
+	// Deterministic normalizes timestamps, permissions and ownership so the
+	// same tree always produces the same archive.
+	Deterministic bool `json:"deterministic,omitempty"`
+
+	// StoreOnly stores every file in zip archives without compression.
+	// Already compressed file types are always stored, see storedExtensions.
+	StoreOnly bool `json:"store_only,omitempty"`
+
+	// Passphrase, when set, encrypts the content of files in zip archives
+	// with WinZip AES-256. It is never stored with a link.
+	Passphrase string `json:"-"`
+
+	// AtRestKey, when set, encrypts archives written by CreateArchive for
+	// storage at rest, see NewEncryptingWriter.
+	AtRestKey []byte `json:"-"`
+
+	// TempDir is where files too large to compress in memory are spooled,
+	// the system default when empty. CreateArchive spools to destDir, so
+	// archives encrypted at rest are not left in plaintext in /tmp.
+	TempDir string `json:"-"`
+
+	// Workers bounds how many files are compressed concurrently, one per
+	// CPU when not positive. The archive is the same for any worker count.
+	Workers int `json:"-"`
+
+	// Progress, when set, is called as file contents are written.
+	Progress func(ArchiveProgress) `json:"-"`
+}
+
+// ArchiveProgress reports how much of an archive has been written.
+type ArchiveProgress struct {
+	Files int   // Files written so far
+	Bytes int64 // Bytes of file content written so far
+}
+
+// progressWriter counts the file content written through it and reports it
+// to the Progress callback.
+type progressWriter struct {
+	w        io.Writer
+	fn       func(ArchiveProgress)
+	progress *ArchiveProgress
+}
+
+func (p progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.progress.Bytes += int64(n)
+	p.fn(*p.progress)
+	return n, err
+}
+
+// deterministicTime is the timestamp of every entry in a deterministic
+// archive, the earliest time representable in a zip file.
+var deterministicTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// deterministicMode keeps the file type and whether a file is executable,
+// dropping every other permission detail.
+func deterministicMode(mode os.FileMode) os.FileMode {
+	switch {
+	case mode&os.ModeSymlink != 0:
+		return os.ModeSymlink | 0777
+	case mode.IsDir():
+		return os.ModeDir | 0755
+	case mode&0111 != 0:
+		return 0755
+	}
+	return 0644
+}
+
+// ArchiveSummary describes what an archive of a directory would contain.
+type ArchiveSummary struct {
+	Files     int   // Regular files and kept symlinks
+	Size      int64 // Total size of the files before compression
+	Skipped   []SkippedEntry
+	Truncated []TruncatedEntry
+
+	// Fingerprint identifies the archive that would be written: it covers
+	// the options and the path, size, modification time and mode of every
+	// entry, so an unchanged tree has the same fingerprint.
+	Fingerprint string
+}
+
+// fingerprintVersion is hashed into every fingerprint and changes whenever
+// the archive writers produce different output for the same tree.
+const fingerprintVersion = "fenfa-archive-2"
+
+// fingerprint accumulates the fingerprint of an archive while its tree is
+// walked.
+type fingerprint struct {
+	h hash.Hash
+}
+
+func newFingerprint(opts ArchiveOptions) *fingerprint {
+	fp := &fingerprint{h: sha256.New()}
+	encoded, _ := json.Marshal(opts)
+	fmt.Fprintf(fp.h, "%s\n%s\n", fingerprintVersion, encoded)
+	return fp
+}
+
+func (fp *fingerprint) add(entry WalkEntry) {
+	fmt.Fprintf(fp.h, "%q %d %d %o %q\n", entry.RelPath, entry.Info.Size(),
+		entry.Info.ModTime().UnixNano(), uint32(entry.Info.Mode()), entry.LinkTarget)
+}
+
+func (fp *fingerprint) sum() string {
+	return hex.EncodeToString(fp.h.Sum(nil))
+}
+
+// OmittedFiles returns the number of files left out by the depth limit.
+func (s ArchiveSummary) OmittedFiles() int {
+	omitted := 0
+	for _, truncated := range s.Truncated {
+		omitted += truncated.Files
+	}
+	return omitted
+}
+
+// ValidFormat reports whether format is a supported archive format.
+func ValidFormat(format string) bool {
+	switch format {
+	case FormatZip, FormatTarGz, FormatTarZst:
+		return true
+	}
+	return false
+}
+
+// Extension returns the file extension for the archive format, e.g. ".tar.gz".
+func (o ArchiveOptions) Extension() string {
+	return "." + o.Format
+}
+
+// ContentType returns the MIME type for the archive format.
+func (o ArchiveOptions) ContentType() string {
+	switch o.Format {
+	case FormatTarGz:
+		return "application/gzip"
+	case FormatTarZst:
+		return "application/zstd"
+	}
+	return "application/zip"
+}
+
+// FileExtension returns the extension of archives written by CreateArchive,
+// which ends in EncryptedExtension when they are encrypted at rest.
+func (o ArchiveOptions) FileExtension() string {
+	if o.AtRestKey != nil {
+		return o.Extension() + EncryptedExtension
+	}
+	return o.Extension()
+}
+
+// symlinkPolicy returns the symlink policy, the default of the format when
+// none is set.
+func (o ArchiveOptions) symlinkPolicy() string {
+	if o.Symlinks != "" {
+		return o.Symlinks
+	}
+	return DefaultSymlinkPolicy(o.Format)
+}
+
+func (o ArchiveOptions) workers() int {
+	if o.Workers > 0 {
+		return o.Workers
+	}
+	return runtime.NumCPU()
+}
+
+func (o ArchiveOptions) walkOptions() (walkOptions, error) {
+	filter, err := newPathFilter(o)
+	if err != nil {
+		return walkOptions{}, err
+	}
+	return walkOptions{
+		maxDepth: o.MaxDepth,
+		symlinks: o.symlinkPolicy(),
+		filter:   filter,
+	}, nil
+}
+
+// CreateArchive archives dirPath into destDir and returns the path of the
+// archive, which is named after the fingerprint of what was archived. The
+// archive is written under a temporary name and renamed once complete, so
+// the source tree is never written to. With AtRestKey set the archive is
+// encrypted as it is written.
+func CreateArchive(dirPath, destDir string, opts ArchiveOptions) (string, error) {
+	if opts.TempDir == "" {
+		opts.TempDir = destDir
+	}
+	archiveFile, err := os.CreateTemp(destDir, ".archive-*")
+	if err != nil {
+		return "", fmt.Errorf("could not create archive file: %v", err)
+	}
+	defer os.Remove(archiveFile.Name())
+
+	fp := newFingerprint(opts)
+	if opts.AtRestKey != nil {
+		var encrypted *EncryptingWriter
+		encrypted, err = NewEncryptingWriter(archiveFile, opts.AtRestKey)
+		if err == nil {
+			err = writeArchive(encrypted, dirPath, opts, fp)
+		}
+		if err == nil {
+			err = encrypted.Close()
+		}
+	} else {
+		err = writeArchive(archiveFile, dirPath, opts, fp)
+	}
+	if closeErr := archiveFile.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("could not write archive file: %v", closeErr)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	name := fp.sum()
+	if opts.Passphrase != "" {
+		// Encrypted archives are specific to their passphrase and never
+		// shared, so they get a name of their own.
+		name, err = GenerateRandomSalt(32)
+		if err != nil {
+			return "", err
+		}
+	}
+	archivePath := filepath.Join(destDir, name+opts.FileExtension())
+	if err := os.Chmod(archiveFile.Name(), 0644); err != nil {
+		return "", fmt.Errorf("could not set archive file permissions: %v", err)
+	}
+	if err := os.Rename(archiveFile.Name(), archivePath); err != nil {
+		return "", fmt.Errorf("could not move archive file: %v", err)
+	}
+
+	return archivePath, nil
+}
+
+// WriteArchive writes an archive of dirPath in the configured format to w.
+func WriteArchive(w io.Writer, dirPath string, opts ArchiveOptions) error {
+	return writeArchive(w, dirPath, opts, nil)
+}
+
+func writeArchive(w io.Writer, dirPath string, opts ArchiveOptions, fp *fingerprint) error {
+	switch opts.Format {
+	case FormatZip, "":
+		return writeZip(w, dirPath, opts, fp)
+	case FormatTarGz:
+		gz := gzip.NewWriter(w)
+		if err := writeTar(gz, dirPath, opts, fp); err != nil {
+			return err
+		}
+		return gz.Close()
+	case FormatTarZst:
+		zw, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(opts.workers()))
+		if err != nil {
+			return fmt.Errorf("could not create zstd writer: %v", err)
+		}
+		if err := writeTar(zw, dirPath, opts, fp); err != nil {
+			zw.Close()
+			return err
+		}
+		return zw.Close()
+	}
+	return fmt.Errorf("unsupported archive format: %s", opts.Format)
+}
+
+func writeTar(w io.Writer, dirPath string, opts ArchiveOptions, fp *fingerprint) error {
+	walkOpts, err := opts.walkOptions()
+	if err != nil {
+		return err
+	}
+	tarWriter := tar.NewWriter(w)
+	var progress ArchiveProgress
+
+	_, err = walkTree(dirPath, walkOpts, func(entry WalkEntry) error {
+		if fp != nil {
+			fp.add(entry)
+		}
+		header, err := tar.FileInfoHeader(entry.Info, entry.LinkTarget)
+		if err != nil {
+			return fmt.Errorf("could not create tar header: %v", err)
+		}
+		header.Name = entry.RelPath
+		if entry.Info.IsDir() {
+			header.Name += "/"
+		}
+		if opts.Deterministic {
+			header.ModTime = deterministicTime
+			header.AccessTime = time.Time{}
+			header.ChangeTime = time.Time{}
+			header.Mode = int64(deterministicMode(entry.Info.Mode()).Perm())
+			header.Uid, header.Gid = 0, 0
+			header.Uname, header.Gname = "", ""
+			header.Format = tar.FormatPAX
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return fmt.Errorf("could not write tar header: %v", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			if !entry.Info.IsDir() {
+				progress.Files++
+			}
+			return nil
+		}
+		return copyFile(tarWriter, entry.FullPath, opts.Progress, &progress)
+	})
+	if err != nil {
+		return fmt.Errorf("could not archive directory: %v", err)
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return fmt.Errorf("could not finish tar file: %v", err)
+	}
+	return nil
+}
+
+// copyFile copies the file at path into an archive entry, reporting
+// progress when a callback is set.
+func copyFile(w io.Writer, path string, fn func(ArchiveProgress), progress *ArchiveProgress) error {
+	sourceFile, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not open file: %v", err)
+	}
+	defer sourceFile.Close()
+
+	if fn != nil {
+		w = progressWriter{w: w, fn: fn, progress: progress}
+	}
+	_, err = io.Copy(w, sourceFile)
+	if err != nil {
+		return fmt.Errorf("could not copy file to archive: %v", err)
+	}
+	progress.Files++
+	if fn != nil {
+		fn(*progress)
+	}
+	return nil
+}
+
+// ScanArchive walks dirPath with the same rules as WriteArchive and
+// summarizes what the archive would contain.
+func ScanArchive(dirPath string, opts ArchiveOptions) (ArchiveSummary, error) {
+	return ListArchive(dirPath, opts, nil)
+}
+
+// ListArchive is like ScanArchive, and also calls fn, when not nil, for every
+// entry the archive would contain.
+func ListArchive(dirPath string, opts ArchiveOptions, fn func(WalkEntry)) (ArchiveSummary, error) {
+	walkOpts, err := opts.walkOptions()
+	if err != nil {
+		return ArchiveSummary{}, err
+	}
+
+	var summary ArchiveSummary
+	fp := newFingerprint(opts)
+	report, err := walkTree(dirPath, walkOpts, func(entry WalkEntry) error {
+		fp.add(entry)
+		if fn != nil {
+			fn(entry)
+		}
+		if entry.Info.IsDir() {
+			return nil
+		}
+		summary.Files++
+		if entry.Info.Mode().IsRegular() {
+			summary.Size += entry.Info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return ArchiveSummary{}, err
+	}
+	summary.Skipped = report.skipped
+	summary.Truncated = report.truncated
+	summary.Fingerprint = fp.sum()
+	return summary, nil
+}
@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteArchiveDefaultSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "target.txt"), []byte("target"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("target.txt", filepath.Join(dir, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("tar.gz preserves links", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := WriteArchive(&buf, dir, ArchiveOptions{Format: FormatTarGz, MaxDepth: -1}); err != nil {
+			t.Fatal(err)
+		}
+		gz, err := gzip.NewReader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader := tar.NewReader(gz)
+		for {
+			header, err := reader.Next()
+			if err == io.EOF {
+				t.Fatal("link.txt missing from archive")
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header.Name != "link.txt" {
+				continue
+			}
+			if header.Typeflag != tar.TypeSymlink || header.Linkname != "target.txt" {
+				t.Errorf("link.txt: type %q to %q, want symlink to target.txt", header.Typeflag, header.Linkname)
+			}
+			return
+		}
+	})
+
+	t.Run("zip follows links", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := WriteArchive(&buf, dir, ArchiveOptions{Format: FormatZip, MaxDepth: -1}); err != nil {
+			t.Fatal(err)
+		}
+		reader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range reader.File {
+			if file.Name != "link.txt" {
+				continue
+			}
+			if file.Mode()&os.ModeSymlink != 0 {
+				t.Errorf("link.txt stored as a link, want the content of target.txt")
+			}
+			return
+		}
+		t.Fatal("link.txt missing from archive")
+	})
+}
+
+func TestWriteArchiveMaxDepth(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"top.txt", "a/one.txt", "a/b/two.txt"} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		maxDepth int
+		want     []string
+	}{
+		{0, []string{"a/", "top.txt"}},
+		{1, []string{"a/", "a/b/", "a/one.txt", "top.txt"}},
+		{-1, []string{"a/", "a/b/", "a/b/two.txt", "a/one.txt", "top.txt"}},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := WriteArchive(&buf, dir, ArchiveOptions{Format: FormatZip, MaxDepth: tt.maxDepth}); err != nil {
+			t.Fatal(err)
+		}
+		reader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, file := range reader.File {
+			got = append(got, file.Name)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("max depth %d: archived %v, want %v", tt.maxDepth, got, tt.want)
+		}
+	}
+}
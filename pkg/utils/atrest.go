@@ -0,0 +1,293 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Files encrypted at rest are a header followed by chunks of AES-256-GCM
+// ciphertext, each holding AtRestChunkSize bytes of plaintext except the
+// last, which may be shorter. Chunks have a fixed size so any offset can be
+// decrypted without reading what comes before it, which keeps HTTP Range
+// requests working. The nonce of chunk i is the base nonce with i XORed into
+// its last 8 bytes, and the additional data is a single byte set to 1 for
+// the last chunk, so reordered or truncated files fail to decrypt.
+//
+// Header: "FENFAENC", version (1 byte), chunk size (4 bytes big-endian),
+// base nonce (12 bytes).
+const (
+	AtRestMagic     = "FENFAENC"
+	AtRestVersion   = 1
+	AtRestChunkSize = 64 * 1024
+	AtRestKeySize   = 32
+
+	// EncryptedExtension is appended to the name of files encrypted at rest.
+	EncryptedExtension = ".enc"
+
+	atRestHeaderSize = len(AtRestMagic) + 1 + 4 + 12
+	atRestTagSize    = 16
+)
+
+// LoadKeyFile reads a key for encryption at rest.
+func LoadKeyFile(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read key file: %w", err)
+	}
+	if len(key) != AtRestKeySize {
+		return nil, fmt.Errorf("key file %s must hold exactly %d bytes", path, AtRestKeySize)
+	}
+	return key, nil
+}
+
+// LoadOrCreateKeyFile reads a key for encryption at rest, generating it
+// first, readable by the owner only, when the file does not exist.
+func LoadOrCreateKeyFile(path string) ([]byte, error) {
+	key := make([]byte, AtRestKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("could not generate key: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		return LoadKeyFile(path)
+	} else if err != nil {
+		return nil, fmt.Errorf("could not create key file: %w", err)
+	}
+	_, err = file.Write(key)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("could not write key file: %w", err)
+	}
+	return key, nil
+}
+
+func newAtRestCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of a chunk, derived from the base nonce.
+func chunkNonce(nonce, base []byte, index uint64) []byte {
+	copy(nonce, base)
+	counter := binary.BigEndian.Uint64(nonce[len(nonce)-8:]) ^ index
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter)
+	return nonce
+}
+
+// chunkAdditionalData marks the last chunk of a file.
+func chunkAdditionalData(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// EncryptingWriter encrypts what is written to it for storage at rest. The
+// last chunk is only written on Close.
+type EncryptingWriter struct {
+	w     io.Writer
+	gcm   cipher.AEAD
+	base  []byte
+	nonce []byte
+	buf   []byte
+	out   []byte
+	index uint64
+}
+
+// NewEncryptingWriter writes the header to w and returns a writer that
+// encrypts to it with key.
+func NewEncryptingWriter(w io.Writer, key []byte) (*EncryptingWriter, error) {
+	gcm, err := newAtRestCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, atRestHeaderSize)
+	copy(header, AtRestMagic)
+	header[len(AtRestMagic)] = AtRestVersion
+	binary.BigEndian.PutUint32(header[len(AtRestMagic)+1:], AtRestChunkSize)
+	base := header[len(AtRestMagic)+5:]
+	if _, err := rand.Read(base); err != nil {
+		return nil, fmt.Errorf("could not generate nonce: %w", err)
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &EncryptingWriter{
+		w:     w,
+		gcm:   gcm,
+		base:  base,
+		nonce: make([]byte, len(base)),
+		buf:   make([]byte, 0, AtRestChunkSize),
+	}, nil
+}
+
+func (e *EncryptingWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only written once more data arrives, since the
+		// last chunk is sealed differently.
+		if len(e.buf) == AtRestChunkSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):AtRestChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close writes the last chunk. It does not close the underlying writer.
+func (e *EncryptingWriter) Close() error {
+	return e.seal(true)
+}
+
+func (e *EncryptingWriter) seal(final bool) error {
+	nonce := chunkNonce(e.nonce, e.base, e.index)
+	e.out = e.gcm.Seal(e.out[:0], nonce, e.buf, chunkAdditionalData(final))
+	if _, err := e.w.Write(e.out); err != nil {
+		return err
+	}
+	e.index++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+// DecryptingReader reads a file encrypted at rest, decrypting the chunk
+// holding the current offset as needed. It implements io.ReadSeeker so it
+// can be passed to http.ServeContent.
+type DecryptingReader struct {
+	r         io.ReaderAt
+	gcm       cipher.AEAD
+	base      []byte
+	chunkSize int64
+	chunks    int64
+	size      int64
+	offset    int64
+
+	nonce      []byte
+	ciphertext []byte
+	plaintext  []byte
+	current    int64 // Index of the chunk in plaintext, -1 for none
+}
+
+// NewDecryptingReader reads the header of an encrypted file of the given
+// size from r and returns a reader of its plaintext.
+func NewDecryptingReader(r io.ReaderAt, size int64, key []byte) (*DecryptingReader, error) {
+	gcm, err := newAtRestCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, atRestHeaderSize)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, fmt.Errorf("could not read header: %w", err)
+	}
+	if string(header[:len(AtRestMagic)]) != AtRestMagic || header[len(AtRestMagic)] != AtRestVersion {
+		return nil, errors.New("not an encrypted file")
+	}
+	chunkSize := int64(binary.BigEndian.Uint32(header[len(AtRestMagic)+1:]))
+	if chunkSize == 0 || chunkSize > 16*AtRestChunkSize {
+		return nil, errors.New("invalid chunk size")
+	}
+
+	// Every chunk but the last is full, and every chunk, even an empty
+	// last one, carries a tag.
+	sealedSize := chunkSize + atRestTagSize
+	body := size - int64(atRestHeaderSize)
+	chunks := (body + sealedSize - 1) / sealedSize
+	if chunks == 0 || body-(chunks-1)*sealedSize < atRestTagSize {
+		return nil, errors.New("encrypted file is truncated")
+	}
+
+	d := &DecryptingReader{
+		r:          r,
+		gcm:        gcm,
+		base:       header[len(AtRestMagic)+5:],
+		chunkSize:  chunkSize,
+		chunks:     chunks,
+		size:       body - chunks*atRestTagSize,
+		nonce:      make([]byte, gcm.NonceSize()),
+		ciphertext: make([]byte, sealedSize),
+		current:    -1,
+	}
+	// Decrypting the last chunk up front authenticates the size, which
+	// would otherwise trust a file cut at a chunk boundary.
+	if err := d.decrypt(chunks - 1); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Size returns the size of the plaintext.
+func (d *DecryptingReader) Size() int64 {
+	return d.size
+}
+
+func (d *DecryptingReader) Read(p []byte) (int, error) {
+	if d.offset >= d.size {
+		return 0, io.EOF
+	}
+	index := d.offset / d.chunkSize
+	if index != d.current {
+		if err := d.decrypt(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plaintext[d.offset-index*d.chunkSize:])
+	d.offset += int64(n)
+	return n, nil
+}
+
+func (d *DecryptingReader) decrypt(index int64) error {
+	sealedSize := d.chunkSize + atRestTagSize
+	start := int64(atRestHeaderSize) + index*sealedSize
+	length := sealedSize
+	final := index == d.chunks-1
+	if final {
+		length = d.size - index*d.chunkSize + atRestTagSize
+	}
+	ciphertext := d.ciphertext[:length]
+	if _, err := d.r.ReadAt(ciphertext, start); err != nil && !(errors.Is(err, io.EOF) && final) {
+		return fmt.Errorf("could not read chunk %d: %w", index, err)
+	}
+
+	nonce := chunkNonce(d.nonce, d.base, uint64(index))
+	plaintext, err := d.gcm.Open(d.plaintext[:0], nonce, ciphertext, chunkAdditionalData(final))
+	if err != nil {
+		d.current = -1
+		return fmt.Errorf("could not decrypt chunk %d: %w", index, err)
+	}
+	d.plaintext, d.current = plaintext, index
+	return nil
+}
+
+func (d *DecryptingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.offset
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	d.offset = offset
+	return offset, nil
+}
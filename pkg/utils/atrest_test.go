@@ -0,0 +1,157 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func encryptAtRest(t *testing.T, content, key []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewEncryptingWriter(&buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestAtRestRoundTrip(t *testing.T) {
+	key := make([]byte, AtRestKeySize)
+	rand.Read(key)
+
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"small", 100},
+		{"one full chunk", AtRestChunkSize},
+		{"one byte over a chunk", AtRestChunkSize + 1},
+		{"several chunks", 3*AtRestChunkSize + 12345},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := make([]byte, tt.size)
+			rand.Read(content)
+			encrypted := encryptAtRest(t, content, key)
+
+			r, err := NewDecryptingReader(bytes.NewReader(encrypted), int64(len(encrypted)), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Size() != int64(tt.size) {
+				t.Errorf("Size() = %d, want %d", r.Size(), tt.size)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("decrypted %d bytes, want the %d encrypted", len(got), len(content))
+			}
+
+			// Ranges are served by seeking, across chunk boundaries too.
+			for _, offset := range []int64{0, AtRestChunkSize - 10, AtRestChunkSize, int64(tt.size) / 2} {
+				if offset > int64(tt.size) {
+					continue
+				}
+				if _, err := r.Seek(offset, io.SeekStart); err != nil {
+					t.Fatal(err)
+				}
+				part := make([]byte, 20)
+				n, err := io.ReadFull(r, part)
+				if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(part[:n], content[offset:offset+int64(n)]) {
+					t.Errorf("read at %d differs from the content", offset)
+				}
+			}
+		})
+	}
+}
+
+func TestAtRestRejectsDamage(t *testing.T) {
+	key := make([]byte, AtRestKeySize)
+	rand.Read(key)
+	content := make([]byte, 2*AtRestChunkSize+100)
+	encrypted := encryptAtRest(t, content, key)
+	sealedSize := AtRestChunkSize + atRestTagSize
+
+	otherKey := make([]byte, AtRestKeySize)
+	rand.Read(otherKey)
+	flipped := bytes.Clone(encrypted)
+	flipped[atRestHeaderSize+10] ^= 1
+
+	tests := []struct {
+		name string
+		data []byte
+		key  []byte
+		// Damage in the middle of a file is only found when that chunk is
+		// read, the rest as the file is opened.
+		onRead bool
+	}{
+		{"wrong key", encrypted, otherKey, false},
+		{"not encrypted", content, key, false},
+		{"cut at a chunk boundary", encrypted[:atRestHeaderSize+sealedSize], key, false},
+		{"cut inside a chunk", encrypted[:len(encrypted)-5], key, false},
+		{"header only", encrypted[:atRestHeaderSize], key, false},
+		{"flipped bit", flipped, key, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewDecryptingReader(bytes.NewReader(tt.data), int64(len(tt.data)), tt.key)
+			if !tt.onRead {
+				if err == nil {
+					t.Error("opened a damaged file")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadAll(r); err == nil {
+				t.Error("read a damaged file")
+			}
+		})
+	}
+}
+
+func TestLoadOrCreateKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "archive.key")
+	created, err := LoadOrCreateKeyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("key file mode = %v, want 0600", info.Mode().Perm())
+	}
+	loaded, err := LoadOrCreateKeyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(created, loaded) {
+		t.Error("existing key file was not reused")
+	}
+
+	if err := os.WriteFile(path, []byte("short"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadKeyFile(path); err == nil {
+		t.Error("loaded a key of the wrong size")
+	}
+}
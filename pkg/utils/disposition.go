@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ContentDisposition formats a Content-Disposition header offering the
+// download under name, following RFC 6266. Names that are not plain ASCII
+// get an ASCII fallback in filename for older clients, and the exact name
+// percent-encoded as UTF-8 in filename* (RFC 5987).
+func ContentDisposition(disposition, name string) string {
+	var fallback strings.Builder
+	ascii := true
+	for _, r := range name {
+		switch {
+		case r < 0x20 || r == 0x7f || r >= utf8.RuneSelf:
+			fallback.WriteByte('_')
+			ascii = false
+		case r == '"' || r == '\\':
+			fallback.WriteByte('\\')
+			fallback.WriteRune(r)
+		default:
+			fallback.WriteRune(r)
+		}
+	}
+
+	header := fmt.Sprintf(`%s; filename="%s"`, disposition, fallback.String())
+	if !ascii {
+		header += "; filename*=UTF-8''" + encodeExtValue(name)
+	}
+	return header
+}
+
+// encodeExtValue percent-encodes every byte of s that is not an attr-char
+// of RFC 5987.
+func encodeExtValue(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&0xf])
+	}
+	return b.String()
+}
+
+// ValidateFilename checks that name can be offered as the name of a
+// download: a single, valid UTF-8 path element without control characters.
+func ValidateFilename(name string) error {
+	switch {
+	case name == "" || name == "." || name == "..":
+		return errors.New("filename cannot be empty, . or ..")
+	case !utf8.ValidString(name):
+		return errors.New("filename must be valid UTF-8")
+	case strings.ContainsAny(name, `/\`):
+		return errors.New("filename cannot contain slashes")
+	case strings.IndexFunc(name, unicode.IsControl) >= 0:
+		return errors.New("filename cannot contain control characters")
+	}
+	return nil
+}
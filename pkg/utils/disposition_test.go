@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"mime"
+	"testing"
+)
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		disposition string
+		name        string
+		want        string
+	}{
+		{"attachment", "report.pdf", `attachment; filename="report.pdf"`},
+		{"inline", "notes.txt", `inline; filename="notes.txt"`},
+		{"attachment", `say "hi"\.txt`, `attachment; filename="say \"hi\"\\.txt"`},
+		{"attachment", "résumé.pdf", `attachment; filename="r_sum_.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`},
+		{"attachment", "a b;c.txt", `attachment; filename="a b;c.txt"`},
+		{"attachment", "日本.txt", `attachment; filename="__.txt"; filename*=UTF-8''%E6%97%A5%E6%9C%AC.txt`},
+		{"attachment", "line\nbreak.txt", `attachment; filename="line_break.txt"; filename*=UTF-8''line%0Abreak.txt`},
+	}
+	for _, tt := range tests {
+		got := ContentDisposition(tt.disposition, tt.name)
+		if got != tt.want {
+			t.Errorf("ContentDisposition(%q, %q) = %s, want %s", tt.disposition, tt.name, got, tt.want)
+			continue
+		}
+		// Clients decoding the header get the exact name back.
+		disposition, params, err := mime.ParseMediaType(got)
+		if err != nil {
+			t.Errorf("ContentDisposition(%q, %q) does not parse: %v", tt.disposition, tt.name, err)
+			continue
+		}
+		if disposition != tt.disposition || params["filename"] != tt.name {
+			t.Errorf("ContentDisposition(%q, %q) parses as %q, %q", tt.disposition, tt.name, disposition, params["filename"])
+		}
+	}
+}
+
+func TestValidateFilename(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{"report.pdf", false},
+		{"résumé final.pdf", false},
+		{".hidden", false},
+		{"", true},
+		{".", true},
+		{"..", true},
+		{"dir/file.txt", true},
+		{`dir\file.txt`, true},
+		{"tab\there.txt", true},
+		{"bad\xffutf8.txt", true},
+	}
+	for _, tt := range tests {
+		if err := ValidateFilename(tt.name); (err != nil) != tt.wantErr {
+			t.Errorf("ValidateFilename(%q) error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
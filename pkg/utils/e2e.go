@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// End-to-end encrypted files are a header followed by chunks of AES-256-GCM
+// ciphertext. The plaintext starts with a 4 byte big-endian length and the
+// JSON encoded E2EMetadata, followed by the content. Each chunk holds
+// E2EChunkSize bytes of plaintext, except the last which may be shorter.
+// The nonce of chunk i is the base nonce with i XORed into its last 8
+// bytes, and the additional data is a single byte set to 1 for the last
+// chunk, so reordered or truncated files fail to decrypt.
+//
+// Header: "FENFAE2E", version (1 byte), chunk size (4 bytes big-endian),
+// base nonce (12 bytes).
+const (
+	E2EMagic     = "FENFAE2E"
+	E2EVersion   = 1
+	E2EChunkSize = 64 * 1024
+	E2EKeySize   = 32
+)
+
+// E2EMetadata describes the encrypted content to the recipient.
+type E2EMetadata struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Size int64  `json:"size,omitempty"` // Unknown for archives built while encrypting
+}
+
+// GenerateE2EKey returns a random key and its URL-safe encoding for the
+// fragment of a link.
+func GenerateE2EKey() ([]byte, string, error) {
+	key := make([]byte, E2EKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, "", fmt.Errorf("could not generate key: %w", err)
+	}
+	return key, base64.RawURLEncoding.EncodeToString(key), nil
+}
+
+// EncryptE2E writes the metadata and the content read from src to dst in
+// the end-to-end encrypted format.
+func EncryptE2E(dst io.Writer, src io.Reader, key []byte, meta E2EMetadata) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, len(E2EMagic)+1+4+gcm.NonceSize())
+	copy(header, E2EMagic)
+	header[len(E2EMagic)] = E2EVersion
+	binary.BigEndian.PutUint32(header[len(E2EMagic)+1:], E2EChunkSize)
+	baseNonce := header[len(E2EMagic)+5:]
+	if _, err := rand.Read(baseNonce); err != nil {
+		return fmt.Errorf("could not generate nonce: %w", err)
+	}
+	if _, err := dst.Write(header); err != nil {
+		return err
+	}
+
+	encodedMeta, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	prefix := binary.BigEndian.AppendUint32(nil, uint32(len(encodedMeta)))
+	plaintext := io.MultiReader(bytes.NewReader(prefix), bytes.NewReader(encodedMeta), src)
+
+	// Read one chunk ahead to know which chunk is the last.
+	current := make([]byte, E2EChunkSize)
+	next := make([]byte, E2EChunkSize)
+	n, err := readChunk(plaintext, current)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, len(baseNonce))
+	var sealed []byte
+	for index := uint64(0); ; index++ {
+		final := n < E2EChunkSize
+		var m int
+		if !final {
+			if m, err = readChunk(plaintext, next); err != nil {
+				return err
+			}
+			final = m == 0
+		}
+
+		sealed = gcm.Seal(sealed[:0], chunkNonce(nonce, baseNonce, index), current[:n], chunkAdditionalData(final))
+		if _, err := dst.Write(sealed); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+		current, next, n = next, current, m
+	}
+}
+
+// readChunk fills buf as far as the reader allows, returning the number of
+// bytes read and no error at the end of the input.
+func readChunk(r io.Reader, buf []byte) (int, error) {
+	n, err := io.ReadFull(r, buf)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return n, nil
+	}
+	return n, err
+}
@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// decryptE2E reverses EncryptE2E as the decryption page does.
+func decryptE2E(data, key []byte) (E2EMetadata, []byte, error) {
+	var meta E2EMetadata
+	headerSize := len(E2EMagic) + 1 + 4 + 12
+	if len(data) < headerSize || string(data[:len(E2EMagic)]) != E2EMagic || data[len(E2EMagic)] != E2EVersion {
+		return meta, nil, errors.New("not an end-to-end encrypted file")
+	}
+	chunkSize := int(binary.BigEndian.Uint32(data[len(E2EMagic)+1:]))
+	base := data[len(E2EMagic)+5 : headerSize]
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return meta, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return meta, nil, err
+	}
+
+	var plaintext []byte
+	nonce := make([]byte, len(base))
+	body := data[headerSize:]
+	for index := uint64(0); ; index++ {
+		sealedSize := min(chunkSize+gcm.Overhead(), len(body))
+		final := sealedSize == len(body)
+		copy(nonce, base)
+		counter := binary.BigEndian.Uint64(nonce[len(nonce)-8:]) ^ index
+		binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter)
+		additional := []byte{0}
+		if final {
+			additional[0] = 1
+		}
+		chunk, err := gcm.Open(nil, nonce, body[:sealedSize], additional)
+		if err != nil {
+			return meta, nil, fmt.Errorf("chunk %d: %w", index, err)
+		}
+		plaintext = append(plaintext, chunk...)
+		body = body[sealedSize:]
+		if final {
+			break
+		}
+	}
+
+	if len(plaintext) < 4 {
+		return meta, nil, errors.New("metadata missing")
+	}
+	length := int(binary.BigEndian.Uint32(plaintext))
+	if len(plaintext) < 4+length {
+		return meta, nil, errors.New("metadata truncated")
+	}
+	if err := json.Unmarshal(plaintext[4:4+length], &meta); err != nil {
+		return meta, nil, err
+	}
+	return meta, plaintext[4+length:], nil
+}
+
+func TestEncryptE2E(t *testing.T) {
+	meta := E2EMetadata{Name: "report.pdf", Type: "application/pdf", Size: 1}
+	encodedMeta, _ := json.Marshal(meta)
+	// Content filling the first chunk exactly, after the metadata.
+	firstChunk := E2EChunkSize - 4 - len(encodedMeta)
+
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"small", 100},
+		{"one full chunk", firstChunk},
+		{"one byte over a chunk", firstChunk + 1},
+		{"several chunks", 3*E2EChunkSize + 12345},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, encoded, err := GenerateE2EKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoded, err := base64.RawURLEncoding.DecodeString(encoded); err != nil || !bytes.Equal(decoded, key) {
+				t.Fatalf("encoded key %q does not decode to the key", encoded)
+			}
+			content := bytes.Repeat([]byte{0xa5}, tt.size)
+			var buf bytes.Buffer
+			if err := EncryptE2E(&buf, bytes.NewReader(content), key, meta); err != nil {
+				t.Fatal(err)
+			}
+
+			gotMeta, got, err := decryptE2E(buf.Bytes(), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotMeta != meta {
+				t.Errorf("metadata = %+v, want %+v", gotMeta, meta)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("decrypted %d bytes, want the %d encrypted", len(got), len(content))
+			}
+
+			otherKey, _, _ := GenerateE2EKey()
+			if _, _, err := decryptE2E(buf.Bytes(), otherKey); err == nil {
+				t.Error("decrypted with another key")
+			}
+			// Cutting the file at a chunk boundary leaves a last chunk not
+			// sealed as the last one.
+			sealedSize := E2EChunkSize + 16
+			if body := buf.Len() - 25; body > sealedSize {
+				if _, _, err := decryptE2E(buf.Bytes()[:25+sealedSize], key); err == nil {
+					t.Error("decrypted a truncated file")
+				}
+			}
+		})
+	}
+}
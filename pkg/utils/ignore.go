@@ -0,0 +1,266 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Names of the ignore files read while walking a directory.
+const (
+	FenfaIgnoreFile = ".fenfaignore"
+	GitIgnoreFile   = ".gitignore"
+)
+
+// ignoreRule is a compiled gitignore-style pattern.
+type ignoreRule struct {
+	base    string // Slash separated directory the rule applies below, "" for the root
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// matches reports whether the rule matches rel, a slash separated path
+// relative to the walk root.
+func (r ignoreRule) matches(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.base != "" {
+		if !strings.HasPrefix(rel, r.base+"/") {
+			return false
+		}
+		rel = rel[len(r.base)+1:]
+	}
+	return r.re.MatchString(rel)
+}
+
+// ValidatePattern reports whether pattern is a valid include or exclude pattern.
+func ValidatePattern(pattern string) error {
+	_, ok, err := compileIgnoreRule("", pattern)
+	if err == nil && !ok {
+		err = fmt.Errorf("empty pattern")
+	}
+	return err
+}
+
+// compileIgnoreRule compiles one line of an ignore file using gitignore
+// syntax. ok is false for blank lines and comments.
+func compileIgnoreRule(base, line string) (rule ignoreRule, ok bool, err error) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false, nil
+	}
+
+	rule.base = base
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return ignoreRule{}, false, nil
+	}
+
+	// Patterns without a slash match at any depth below the base.
+	if strings.Contains(line, "/") {
+		line = strings.TrimPrefix(line, "/")
+	} else {
+		line = "**/" + line
+	}
+
+	rule.re, err = regexp.Compile("^" + globToRegexp(line) + "$")
+	if err != nil {
+		return ignoreRule{}, false, fmt.Errorf("invalid pattern %q: %v", line, err)
+	}
+	return rule, true, nil
+}
+
+// globToRegexp translates a gitignore glob into a regular expression.
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+			b.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// loadIgnoreFile reads the rules of an ignore file in the directory rel.
+// A missing file yields no rules.
+func loadIgnoreFile(fullPath, rel string) ([]ignoreRule, error) {
+	file, err := os.Open(fullPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s: %v", fullPath, err)
+	}
+	defer file.Close()
+
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		rule, ok, err := compileIgnoreRule(rel, scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", fullPath, err)
+		}
+		if ok {
+			rules = append(rules, rule)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read %s: %v", fullPath, err)
+	}
+	return rules, nil
+}
+
+// pathFilter decides which entries of a tree are archived.
+type pathFilter struct {
+	include     []ignoreRule // Files must match one of these when set
+	exclude     []ignoreRule // Entries matching any of these are left out
+	ignoreFiles []string     // Ignore files honored in every directory
+}
+
+func newPathFilter(opts ArchiveOptions) (*pathFilter, error) {
+	filter := &pathFilter{ignoreFiles: []string{FenfaIgnoreFile}}
+	if opts.GitIgnore {
+		filter.ignoreFiles = append(filter.ignoreFiles, GitIgnoreFile)
+	}
+	for _, pattern := range opts.Include {
+		rule, ok, err := compileIgnoreRule("", pattern)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			filter.include = append(filter.include, rule)
+		}
+	}
+	for _, pattern := range opts.Exclude {
+		rule, ok, err := compileIgnoreRule("", pattern)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			filter.exclude = append(filter.exclude, rule)
+		}
+	}
+	return filter, nil
+}
+
+// enter returns the rules in effect inside the directory rel, given the
+// rules of its parent.
+func (f *pathFilter) enter(rules []ignoreRule, fullPath, rel string) ([]ignoreRule, error) {
+	rules = rules[:len(rules):len(rules)]
+	for _, name := range f.ignoreFiles {
+		loaded, err := loadIgnoreFile(filepath.Join(fullPath, name), rel)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, loaded...)
+	}
+	return rules, nil
+}
+
+// excluded reports whether rel is left out by the exclude patterns or the
+// ignore file rules. As in git, the last matching rule wins.
+func (f *pathFilter) excluded(rules []ignoreRule, rel string, isDir bool) bool {
+	if name := rel[strings.LastIndex(rel, "/")+1:]; name == FenfaIgnoreFile {
+		return true
+	}
+	for _, rule := range f.exclude {
+		if rule.matches(rel, isDir) {
+			return true
+		}
+	}
+	ignored := false
+	for _, rule := range rules {
+		if rule.matches(rel, isDir) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// included reports whether a file matches the include patterns, if any.
+func (f *pathFilter) included(rel string) bool {
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, rule := range f.include {
+		if rule.matches(rel, false) {
+			return true
+		}
+	}
+	return false
+}
+
+// PathExcluded reports whether rel, a slash separated path below root, is
+// left out by the filters in opts. Ignore files in root and every directory
+// on the way to rel are honored.
+func PathExcluded(root, rel string, isDir bool, opts ArchiveOptions) (bool, error) {
+	filter, err := newPathFilter(opts)
+	if err != nil {
+		return false, err
+	}
+	rules, err := filter.enter(nil, root, "")
+	if err != nil {
+		return false, err
+	}
+
+	segments := strings.Split(rel, "/")
+	for i := range segments {
+		current := strings.Join(segments[:i+1], "/")
+		last := i == len(segments)-1
+		if filter.excluded(rules, current, isDir || !last) {
+			return true, nil
+		}
+		if last {
+			break
+		}
+		rules, err = filter.enter(rules, filepath.Join(root, filepath.FromSlash(current)), current)
+		if err != nil {
+			return false, err
+		}
+	}
+	return !isDir && !filter.included(rel), nil
+}
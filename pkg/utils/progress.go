@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+const (
+	progressBarWidth     = 24
+	terminalRedrawPeriod = 100 * time.Millisecond
+	plainLinePeriod      = 5 * time.Second
+)
+
+// ProgressReporter prints the progress of a long running operation to
+// stderr: a bar redrawn in place on terminals, or a plain line every few
+// seconds otherwise. Nothing is printed for operations that finish before
+// the first update is due. A nil reporter prints nothing.
+type ProgressReporter struct {
+	label      string
+	totalFiles int // 0 when the total is unknown
+	totalBytes int64
+
+	out      io.Writer
+	terminal bool
+	started  time.Time
+	printed  time.Time // Zero until the first line is printed
+	files    int
+	bytes    int64
+}
+
+// NewProgressReporter starts reporting an operation over the given number
+// of files and bytes. Pass zero totals when they are not known up front.
+func NewProgressReporter(label string, totalFiles int, totalBytes int64) *ProgressReporter {
+	return &ProgressReporter{
+		label:      label,
+		totalFiles: totalFiles,
+		totalBytes: totalBytes,
+		out:        os.Stderr,
+		terminal:   term.IsTerminal(int(os.Stderr.Fd())),
+		started:    time.Now(),
+	}
+}
+
+// Update records how many files and bytes have been processed so far and
+// prints them when an update is due.
+func (p *ProgressReporter) Update(files int, bytes int64) {
+	if p == nil {
+		return
+	}
+	p.files, p.bytes = files, bytes
+
+	period := plainLinePeriod
+	if p.terminal {
+		period = terminalRedrawPeriod
+	}
+	last := p.printed
+	if last.IsZero() {
+		last = p.started
+	}
+	if time.Since(last) >= period {
+		p.print()
+	}
+}
+
+// Finish prints the final state, when anything was printed before, and ends
+// the line of a terminal bar.
+func (p *ProgressReporter) Finish() {
+	if p == nil || p.printed.IsZero() {
+		return
+	}
+	p.print()
+	if p.terminal {
+		fmt.Fprintln(p.out)
+	}
+}
+
+func (p *ProgressReporter) print() {
+	p.printed = time.Now()
+	elapsed := p.printed.Sub(p.started).Seconds()
+
+	var parts []string
+	if p.totalFiles > 0 {
+		parts = append(parts, fmt.Sprintf("%d/%d files", p.files, p.totalFiles),
+			fmt.Sprintf("%s/%s", FormatBytes(p.bytes), FormatBytes(p.totalBytes)))
+	} else {
+		parts = append(parts, fmt.Sprintf("%d files", p.files), FormatBytes(p.bytes))
+	}
+	if elapsed > 0 {
+		rate := float64(p.bytes) / elapsed
+		parts = append(parts, FormatBytes(int64(rate))+"/s")
+		if p.totalBytes > 0 && rate > 0 && p.bytes < p.totalBytes {
+			eta := time.Duration(float64(p.totalBytes-p.bytes)/rate) * time.Second
+			parts = append(parts, "ETA "+eta.Round(time.Second).String())
+		}
+	}
+	status := strings.Join(parts, ", ")
+
+	if !p.terminal {
+		if percent, ok := p.percent(); ok {
+			fmt.Fprintf(p.out, "%s: %d%%, %s\n", p.label, percent, status)
+		} else {
+			fmt.Fprintf(p.out, "%s: %s\n", p.label, status)
+		}
+		return
+	}
+	if percent, ok := p.percent(); ok {
+		filled := percent * progressBarWidth / 100
+		bar := strings.Repeat("#", filled) + strings.Repeat("-", progressBarWidth-filled)
+		fmt.Fprintf(p.out, "\r%s [%s] %3d%%  %s\x1b[K", p.label, bar, percent, status)
+	} else {
+		fmt.Fprintf(p.out, "\r%s: %s\x1b[K", p.label, status)
+	}
+}
+
+// percent returns how much is done, by bytes when the total size is known
+// and by files otherwise.
+func (p *ProgressReporter) percent() (int, bool) {
+	switch {
+	case p.totalBytes > 0:
+		return int(min(p.bytes*100/p.totalBytes, 100)), true
+	case p.totalFiles > 0:
+		return min(p.files*100/p.totalFiles, 100), true
+	}
+	return 0, false
+}
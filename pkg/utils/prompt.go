@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/term"
+)
+
+// PromptPassword reads a password from the terminal without echoing it. The
+// password has to be entered twice and must not be empty.
+func PromptPassword(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("cannot prompt for a password: stdin is not a terminal")
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	first, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("could not read password: %w", err)
+	}
+	if len(first) == 0 {
+		return "", fmt.Errorf("password cannot be empty")
+	}
+
+	fmt.Fprint(os.Stderr, "Confirm: ")
+	second, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("could not read password: %w", err)
+	}
+	if string(first) != string(second) {
+		return "", fmt.Errorf("passwords do not match")
+	}
+	return string(first), nil
+}
@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timestampLayouts are tried in order by ParseTimestamp. Layouts without a
+// zone are interpreted in the local time zone.
+var timestampLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+var dayWeekUnit = regexp.MustCompile(`(\d+(?:\.\d+)?)([dw])`)
+
+// ParseDuration parses a duration like time.ParseDuration, additionally
+// accepting "d" (days) and "w" (weeks) units, e.g. "7d" or "1w2d12h".
+func ParseDuration(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, fmt.Errorf("empty duration")
+	}
+
+	var convErr error
+	expanded := dayWeekUnit.ReplaceAllStringFunc(value, func(token string) string {
+		parts := dayWeekUnit.FindStringSubmatch(token)
+		n, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			convErr = err
+			return token
+		}
+		hours := n * 24
+		if parts[2] == "w" {
+			hours *= 7
+		}
+		return strconv.FormatFloat(hours, 'f', -1, 64) + "h"
+	})
+	if convErr != nil {
+		return 0, fmt.Errorf("invalid duration %q: %v", value, convErr)
+	}
+
+	d, err := time.ParseDuration(expanded)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return d, nil
+}
+
+// ParseTimestamp parses an absolute point in time such as
+// "2026-11-01T17:00" or an RFC 3339 timestamp.
+func ParseTimestamp(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range timestampLayouts {
+		t, err := time.ParseInLocation(layout, value, time.Local)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q", value)
+}
@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"90m", 90 * time.Minute, false},
+		{"7d", 7 * 24 * time.Hour, false},
+		{"1w", 7 * 24 * time.Hour, false},
+		{"1w2d12h", 9*24*time.Hour + 12*time.Hour, false},
+		{"1.5d", 36 * time.Hour, false},
+		{" 2h ", 2 * time.Hour, false},
+		{"", 0, true},
+		{"7", 0, true},
+		{"7x", 0, true},
+		{"d", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseDuration(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseDuration(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseDuration(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{"2026-11-01T17:00:00Z", time.Date(2026, 11, 1, 17, 0, 0, 0, time.UTC), false},
+		{"2026-11-01T17:00", time.Date(2026, 11, 1, 17, 0, 0, 0, time.Local), false},
+		{"2026-11-01 17:00:30", time.Date(2026, 11, 1, 17, 0, 30, 0, time.Local), false},
+		{"2026-11-01", time.Date(2026, 11, 1, 0, 0, 0, 0, time.Local), false},
+		{"01/11/2026", time.Time{}, true},
+		{"", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseTimestamp(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseTimestamp(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("ParseTimestamp(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
@@ -1,15 +1,15 @@
 package utils
 
 import (
-	"archive/zip"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 func GenerateRandomSalt(length int) (string, error) {
@@ -34,113 +34,6 @@ func Encode(input string) (string, error) {
 	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
-func ZipDirectory(dirPath string, maxDepth int) (string, error) {
-	zipPath := dirPath + ".zip"
-	zipFile, err := os.Create(zipPath)
-	if err != nil {
-		return "", fmt.Errorf("could not create zip file: %v", err)
-	}
-	defer zipFile.Close()
-
-	zipWriter := zip.NewWriter(zipFile)
-	defer zipWriter.Close()
-
-	err = addFilesToZip(zipWriter, dirPath, "", 0, maxDepth)
-	if err != nil {
-		return "", fmt.Errorf("could not zip directory: %v", err)
-	}
-
-	return zipPath, nil
-}
-
-func addFilesToZip(zipWriter *zip.Writer, basePath, relativePath string, currentDepth, maxDepth int) error {
-	if maxDepth >= 0 && currentDepth > maxDepth {
-		return nil
-	}
-
-	fullPath := filepath.Join(basePath, relativePath)
-	fileInfo, err := os.Stat(fullPath)
-	if err != nil {
-		return fmt.Errorf("could not stat file: %v", err)
-	}
-
-	if fileInfo.IsDir() {
-		if relativePath != "" {
-			_, err := zipWriter.Create(relativePath + "/")
-			if err != nil {
-				return fmt.Errorf("could not create directory in zip: %v", err)
-			}
-		}
-
-		files, err := os.ReadDir(fullPath)
-		if err != nil {
-			return fmt.Errorf("could not read directory: %v", err)
-		}
-
-		for _, file := range files {
-			err = addFilesToZip(zipWriter, basePath, filepath.Join(relativePath, file.Name()), currentDepth+1, maxDepth)
-			if err != nil {
-				return err
-			}
-		}
-	} else {
-		zipFileWriter, err := zipWriter.Create(relativePath)
-		if err != nil {
-			return fmt.Errorf("could not create file in zip: %v", err)
-		}
-
-		sourceFile, err := os.Open(fullPath)
-		if err != nil {
-			return fmt.Errorf("could not open file: %v", err)
-		}
-		defer sourceFile.Close()
-
-		_, err = io.Copy(zipFileWriter, sourceFile)
-		if err != nil {
-			return fmt.Errorf("could not copy file to zip: %v", err)
-		}
-	}
-
-	return nil
-}
-
-func EstimateZipSize(dirPath string, maxDepth int) (int64, error) {
-	return estimateSizeHelper(dirPath, "", 0, maxDepth)
-}
-
-func estimateSizeHelper(basePath, relativePath string, currentDepth, maxDepth int) (int64, error) {
-	if maxDepth >= 0 && currentDepth > maxDepth {
-		return 0, nil
-	}
-
-	fullPath := filepath.Join(basePath, relativePath)
-	fileInfo, err := os.Stat(fullPath)
-	if err != nil {
-		return 0, fmt.Errorf("could not stat file: %v", err)
-	}
-
-	totalSize := int64(0)
-
-	if fileInfo.IsDir() {
-		files, err := os.ReadDir(fullPath)
-		if err != nil {
-			return 0, fmt.Errorf("could not read directory: %v", err)
-		}
-
-		for _, file := range files {
-			size, err := estimateSizeHelper(basePath, filepath.Join(relativePath, file.Name()), currentDepth+1, maxDepth)
-			if err != nil {
-				return 0, err
-			}
-			totalSize += size
-		}
-	} else {
-		totalSize += fileInfo.Size()
-	}
-
-	return totalSize, nil
-}
-
 func fileExists(path string) bool {
 	_, err := os.Stat(path)
 	return err == nil
@@ -161,3 +54,61 @@ func ResolveToAbsolutePath(path string) (string, error) {
 
 	return "", fmt.Errorf("file not found: %s", path)
 }
+
+// IsWithin reports whether path is root or lies below it.
+func IsWithin(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// FormatBytes renders a byte count in human readable units, e.g. "1.5 MB".
+func FormatBytes(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "kMGTPE"[exp])
+}
+
+var byteUnits = map[string]int64{
+	"":    1,
+	"B":   1,
+	"K":   1000,
+	"KB":  1000,
+	"M":   1000 * 1000,
+	"MB":  1000 * 1000,
+	"G":   1000 * 1000 * 1000,
+	"GB":  1000 * 1000 * 1000,
+	"T":   1000 * 1000 * 1000 * 1000,
+	"TB":  1000 * 1000 * 1000 * 1000,
+	"KIB": 1 << 10,
+	"MIB": 1 << 20,
+	"GIB": 1 << 30,
+	"TIB": 1 << 40,
+}
+
+// ParseBytes parses a size such as "500MB", "2GiB" or "1048576".
+func ParseBytes(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	i := strings.IndexFunc(value, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(value)
+	}
+	unit, ok := byteUnits[strings.TrimSpace(value[i:])]
+	if !ok || i == 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	n, err := strconv.ParseFloat(value[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return int64(n * float64(unit)), nil
+}
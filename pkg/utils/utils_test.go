@@ -0,0 +1,34 @@
+package utils
+
+import "testing"
+
+func TestParseBytes(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{"1048576", 1048576, false},
+		{"512B", 512, false},
+		{"500MB", 500 * 1000 * 1000, false},
+		{"500mb", 500 * 1000 * 1000, false},
+		{"2GiB", 2 << 30, false},
+		{"1.5K", 1500, false},
+		{" 10 MiB ", 10 << 20, false},
+		{"", 0, true},
+		{"MB", 0, true},
+		{"-5MB", 0, true},
+		{"10XB", 0, true},
+		{"1.2.3MB", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseBytes(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseBytes(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseBytes(%q) = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
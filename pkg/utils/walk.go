@@ -0,0 +1,312 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Symlink policies for archives and browsable directories.
+const (
+	SymlinkFollow           = "follow"             // Archive what links point to
+	SymlinkSkip             = "skip"               // Leave links out
+	SymlinkPreserve         = "preserve-as-link"   // Store links as links
+	SymlinkFollowWithinRoot = "follow-within-root" // Follow links that stay inside the shared directory
+)
+
+// ValidSymlinkPolicy reports whether policy is a supported symlink policy.
+func ValidSymlinkPolicy(policy string) bool {
+	switch policy {
+	case SymlinkFollow, SymlinkSkip, SymlinkPreserve, SymlinkFollowWithinRoot:
+		return true
+	}
+	return false
+}
+
+// DefaultSymlinkPolicy returns the symlink policy of an archive format when
+// none is configured. Tarballs keep links as links, while zips, which most
+// extractors cannot restore links from, follow links inside the root.
+func DefaultSymlinkPolicy(format string) string {
+	switch format {
+	case FormatTarGz, FormatTarZst:
+		return SymlinkPreserve
+	}
+	return SymlinkFollowWithinRoot
+}
+
+// WalkEntry is a file or directory visited by walkTree.
+type WalkEntry struct {
+	RelPath    string // Slash separated path below the root
+	FullPath   string
+	Info       os.FileInfo
+	LinkTarget string // Target of a symlink that is kept as a link
+}
+
+// SkippedEntry is an entry left out of a walk and the reason why.
+type SkippedEntry struct {
+	RelPath string
+	Reason  string
+}
+
+// TruncatedEntry is a directory whose contents were left out because they
+// lie beyond the depth limit.
+type TruncatedEntry struct {
+	RelPath string // Slash separated, "" for the root
+	Files   int    // Files below the directory that were left out
+}
+
+// walkReport lists what a walk left out.
+type walkReport struct {
+	skipped   []SkippedEntry
+	truncated []TruncatedEntry
+}
+
+type walkOptions struct {
+	maxDepth int    // Subdirectory levels to descend into, negative for unlimited
+	symlinks string // One of the Symlink policies
+	filter   *pathFilter
+}
+
+type walker struct {
+	root     string
+	realRoot string // root with symlinks resolved
+	opts     walkOptions
+	fn       func(WalkEntry) error
+
+	// ancestors holds the directories currently being walked, used to
+	// detect symlink cycles.
+	ancestors []os.FileInfo
+	// pending holds directories not reported yet because include patterns
+	// are in use; they are reported once a file below them is included.
+	pending []WalkEntry
+	report  walkReport
+}
+
+// walkTree calls fn for every entry below root, parents before children and
+// in lexical order, honoring the depth limit, filters and symlink policy. The
+// root itself is not visited. Entries left out for reasons the caller should
+// know about, such as special files, symlink cycles or the depth limit, are
+// returned in the report.
+func walkTree(root string, opts walkOptions, fn func(WalkEntry) error) (walkReport, error) {
+	if opts.filter == nil {
+		opts.filter = &pathFilter{}
+	}
+	w := &walker{root: root, opts: opts, fn: fn}
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return walkReport{}, fmt.Errorf("could not resolve directory: %v", err)
+	}
+	w.realRoot = realRoot
+	rootInfo, err := os.Stat(root)
+	if err != nil {
+		return walkReport{}, fmt.Errorf("could not stat file: %v", err)
+	}
+
+	rules, err := opts.filter.enter(nil, root, "")
+	if err != nil {
+		return walkReport{}, err
+	}
+	err = w.walkDir(root, "", 0, rootInfo, rules)
+	return w.report, err
+}
+
+func (w *walker) walkDir(fullPath, relativePath string, currentDepth int, info os.FileInfo, rules []ignoreRule) error {
+	if w.opts.maxDepth >= 0 && currentDepth > w.opts.maxDepth {
+		return w.truncate(fullPath, relativePath, currentDepth, info, rules)
+	}
+
+	w.ancestors = append(w.ancestors, info)
+	defer func() { w.ancestors = w.ancestors[:len(w.ancestors)-1] }()
+
+	files, err := os.ReadDir(fullPath)
+	if err != nil {
+		return fmt.Errorf("could not read directory: %v", err)
+	}
+
+	for _, file := range files {
+		if err := w.visit(path.Join(relativePath, file.Name()), currentDepth+1, rules); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *walker) visit(relativePath string, currentDepth int, rules []ignoreRule) error {
+	fullPath := filepath.Join(w.root, filepath.FromSlash(relativePath))
+	entry := WalkEntry{RelPath: relativePath, FullPath: fullPath}
+
+	fileInfo, err := os.Lstat(fullPath)
+	if err != nil {
+		return fmt.Errorf("could not stat file: %v", err)
+	}
+	skipReason := ""
+	if fileInfo.Mode()&os.ModeSymlink != 0 {
+		if w.opts.symlinks == SymlinkSkip {
+			return nil
+		}
+		fileInfo, entry.LinkTarget, skipReason = w.resolveSymlink(fullPath, fileInfo)
+	}
+	entry.Info = fileInfo
+
+	filter := w.opts.filter
+	if filter.excluded(rules, relativePath, fileInfo.IsDir()) {
+		return nil
+	}
+	if skipReason == "" && isSpecialFile(fileInfo) {
+		skipReason = "special file (socket, FIFO or device)"
+	}
+	if skipReason == "" && fileInfo.IsDir() && w.isAncestor(fileInfo) {
+		skipReason = "symlink cycle"
+	}
+	if skipReason != "" {
+		w.report.skipped = append(w.report.skipped, SkippedEntry{RelPath: relativePath, Reason: skipReason})
+		return nil
+	}
+
+	if !fileInfo.IsDir() {
+		if !filter.included(relativePath) {
+			return nil
+		}
+		return w.emit(entry)
+	}
+
+	if len(filter.include) > 0 {
+		w.pending = append(w.pending, entry)
+	} else if err := w.emit(entry); err != nil {
+		return err
+	}
+
+	rules, err = filter.enter(rules, fullPath, relativePath)
+	if err != nil {
+		return err
+	}
+	if err := w.walkDir(fullPath, relativePath, currentDepth, fileInfo, rules); err != nil {
+		return err
+	}
+
+	if n := len(w.pending); n > 0 && w.pending[n-1].RelPath == relativePath {
+		w.pending = w.pending[:n-1]
+	}
+	return nil
+}
+
+// resolveSymlink applies the symlink policy to the link at fullPath. It
+// returns the info to archive, the link target when the link is kept as a
+// link, or a reason to skip it.
+func (w *walker) resolveSymlink(fullPath string, linkInfo os.FileInfo) (os.FileInfo, string, string) {
+	switch w.opts.symlinks {
+	case SymlinkPreserve:
+		target, err := os.Readlink(fullPath)
+		if err != nil {
+			return linkInfo, "", "unreadable symlink"
+		}
+		return linkInfo, target, ""
+	case SymlinkFollowWithinRoot:
+		resolved, err := filepath.EvalSymlinks(fullPath)
+		if err != nil {
+			return linkInfo, "", "broken symlink"
+		}
+		if !IsWithin(w.realRoot, resolved) {
+			return linkInfo, "", "symlink points outside the shared directory"
+		}
+	}
+
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return linkInfo, "", "broken symlink"
+	}
+	return info, "", ""
+}
+
+func (w *walker) isAncestor(info os.FileInfo) bool {
+	for _, ancestor := range w.ancestors {
+		if os.SameFile(ancestor, info) {
+			return true
+		}
+	}
+	return false
+}
+
+// truncate records a directory at the depth limit, counting the files below
+// it that are left out with the same filters and symlink policy.
+func (w *walker) truncate(fullPath, relativePath string, currentDepth int, info os.FileInfo, rules []ignoreRule) error {
+	opts := w.opts
+	opts.maxDepth = -1
+	files := 0
+	counter := &walker{
+		root:      w.root,
+		realRoot:  w.realRoot,
+		opts:      opts,
+		ancestors: append([]os.FileInfo(nil), w.ancestors...),
+		fn: func(entry WalkEntry) error {
+			if !entry.Info.IsDir() {
+				files++
+			}
+			return nil
+		},
+	}
+	if err := counter.walkDir(fullPath, relativePath, currentDepth, info, rules); err != nil {
+		return err
+	}
+	if files > 0 {
+		w.report.truncated = append(w.report.truncated, TruncatedEntry{RelPath: relativePath, Files: files})
+	}
+	return nil
+}
+
+// emit passes an entry to the callback, after any pending parents.
+func (w *walker) emit(entry WalkEntry) error {
+	for _, parent := range w.pending {
+		if err := w.fn(parent); err != nil {
+			return err
+		}
+	}
+	w.pending = w.pending[:0]
+	return w.fn(entry)
+}
+
+func isSpecialFile(info os.FileInfo) bool {
+	return info.Mode()&(os.ModeSocket|os.ModeNamedPipe|os.ModeDevice|os.ModeCharDevice|os.ModeIrregular) != 0
+}
+
+// PathAllowed reports whether rel, a slash separated path below root, may be
+// served under the symlink policy in opts. Special files are never allowed.
+func PathAllowed(root, rel string, opts ArchiveOptions) (bool, error) {
+	fullPath := filepath.Join(root, filepath.FromSlash(rel))
+	switch opts.symlinkPolicy() {
+	case SymlinkSkip, SymlinkPreserve:
+		// Links cannot be served as links, so neither policy follows them.
+		current := root
+		for _, segment := range strings.Split(rel, "/") {
+			current = filepath.Join(current, segment)
+			info, err := os.Lstat(current)
+			if err != nil {
+				return false, err
+			}
+			if info.Mode()&os.ModeSymlink != 0 {
+				return false, nil
+			}
+		}
+	case SymlinkFollowWithinRoot:
+		realRoot, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			return false, err
+		}
+		resolved, err := filepath.EvalSymlinks(fullPath)
+		if err != nil {
+			return false, err
+		}
+		if !IsWithin(realRoot, resolved) {
+			return false, nil
+		}
+	}
+
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return false, err
+	}
+	return !isSpecialFile(info), nil
+}
@@ -0,0 +1,356 @@
+package utils
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// storedExtensions lists file types that are already prepared. Zip
+// archives store them as they are instead of compressing them again.
+var storedExtensions = map[string]bool{
+	".7z": true, ".aac": true, ".avi": true, ".br": true, ".bz2": true, ".docx": true, ".flac": true,
+	".gif": true, ".gz": true, ".heic": true, ".jar": true, ".jpeg": true, ".jpg": true, ".m4a": true,
+	".m4v": true, ".mkv": true, ".mov": true, ".mp3": true, ".mp4": true, ".ogg": true, ".opus": true,
+	".png": true, ".pptx": true, ".rar": true, ".tgz": true, ".webm": true, ".webp": true, ".xlsx": true,
+	".xz": true, ".zip": true, ".zst": true,
+}
+
+const (
+	// deflateLevel matches the level archive/zip uses for Deflate.
+	deflateLevel = 5
+	// spoolMemoryLimit is the largest file compressed in memory while it
+	// waits for its turn in the archive; larger files are compressed into
+	// a temporary file.
+	spoolMemoryLimit = 1 << 20
+)
+
+var errArchiveAborted = errors.New("archive aborted")
+
+// zipItem is an entry of a zip archive, in walk order. Files that are
+// compressed or encrypted by a worker carry a channel delivering the result.
+type zipItem struct {
+	entry  WalkEntry
+	header *zip.FileHeader
+	result chan preparedFile
+}
+
+// preparedFile is the content of a file as stored in the archive,
+// compressed and possibly encrypted, kept in memory or in a temporary file
+// until it is written to the archive.
+type preparedFile struct {
+	data           *bytes.Buffer
+	file           *os.File
+	crc32          uint32
+	size           int64
+	compressedSize int64
+	err            error
+}
+
+// writeZip writes a zip archive of dirPath. Files are compressed, and
+// encrypted when a passphrase is set, concurrently by up to opts.workers()
+// workers and written in walk order, so the archive does not depend on the
+// number of workers.
+func writeZip(w io.Writer, dirPath string, opts ArchiveOptions, fp *fingerprint) error {
+	// Symlinks are stored with their target as content, which extractors
+	// cannot read back once encrypted, and would leak the target otherwise.
+	if opts.Passphrase != "" && opts.symlinkPolicy() == SymlinkPreserve {
+		return errors.New("symlinks cannot be preserved in an encrypted archive")
+	}
+	walkOpts, err := opts.walkOptions()
+	if err != nil {
+		return err
+	}
+
+	workers := opts.workers()
+	items := make(chan zipItem, workers)
+	abort := make(chan struct{})
+	walkErr := make(chan error, 1)
+	go func() {
+		defer close(items)
+		slots := make(chan struct{}, workers)
+		_, err := walkTree(dirPath, walkOpts, func(entry WalkEntry) error {
+			if fp != nil {
+				fp.add(entry)
+			}
+			item, err := newZipItem(entry, opts)
+			if err != nil {
+				return err
+			}
+			if item.header.Method == zip.Deflate || (opts.Passphrase != "" && entry.Info.Mode().IsRegular()) {
+				select {
+				case slots <- struct{}{}:
+				case <-abort:
+					return errArchiveAborted
+				}
+				item.result = make(chan preparedFile, 1)
+				go func() {
+					item.result <- prepareFile(entry.FullPath, entry.Info.Size(), item.header.Method, opts.Passphrase, opts.TempDir)
+					<-slots
+				}()
+			}
+			select {
+			case items <- item:
+				return nil
+			case <-abort:
+				go item.discard()
+				return errArchiveAborted
+			}
+		})
+		walkErr <- err
+	}()
+
+	zipWriter := zip.NewWriter(w)
+	var progress ArchiveProgress
+	for item := range items {
+		if err != nil {
+			item.discard()
+			continue
+		}
+		if err = writeZipItem(zipWriter, item, opts, &progress); err != nil {
+			close(abort)
+		}
+	}
+	if walkErr := <-walkErr; err == nil {
+		err = walkErr
+	}
+	if err != nil {
+		return fmt.Errorf("could not zip directory: %v", err)
+	}
+
+	if err := zipWriter.Close(); err != nil {
+		return fmt.Errorf("could not finish zip file: %v", err)
+	}
+	return nil
+}
+
+func newZipItem(entry WalkEntry, opts ArchiveOptions) (zipItem, error) {
+	header, err := zip.FileInfoHeader(entry.Info)
+	if err != nil {
+		return zipItem{}, fmt.Errorf("could not create zip header: %v", err)
+	}
+	header.Name = entry.RelPath
+	header.Method = zip.Deflate
+	if entry.Info.IsDir() || entry.LinkTarget != "" || opts.StoreOnly ||
+		storedExtensions[strings.ToLower(path.Ext(entry.RelPath))] {
+		header.Method = zip.Store
+	}
+	if entry.Info.IsDir() {
+		header.Name += "/"
+	}
+	if opts.Deterministic {
+		header.Modified = deterministicTime
+		header.SetMode(deterministicMode(entry.Info.Mode()))
+	}
+	return zipItem{entry: entry, header: header}, nil
+}
+
+// writeZipItem adds an entry to the archive, waiting for its content when
+// a worker prepares it.
+func writeZipItem(zipWriter *zip.Writer, item zipItem, opts ArchiveOptions, progress *ArchiveProgress) error {
+	if item.result != nil {
+		prepared := <-item.result
+		defer prepared.cleanup()
+		if prepared.err != nil {
+			return prepared.err
+		}
+
+		header := item.header
+		header.CRC32 = prepared.crc32
+		header.CompressedSize64 = uint64(prepared.compressedSize)
+		header.UncompressedSize64 = uint64(prepared.size)
+		prepareRawHeader(header)
+		if opts.Passphrase != "" {
+			header.Flags |= 0x1
+			header.Extra = append(header.Extra, winZipAESExtra(header.Method)...)
+			header.Method = winZipAESMethod
+			header.CRC32 = 0
+		}
+		zipFileWriter, err := zipWriter.CreateRaw(header)
+		if err != nil {
+			return fmt.Errorf("could not create file in zip: %v", err)
+		}
+		content, err := prepared.reader()
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(zipFileWriter, content); err != nil {
+			return fmt.Errorf("could not copy file to archive: %v", err)
+		}
+		progress.Files++
+		progress.Bytes += prepared.size
+		if opts.Progress != nil {
+			opts.Progress(*progress)
+		}
+		return nil
+	}
+
+	zipFileWriter, err := zipWriter.CreateHeader(item.header)
+	if err != nil {
+		return fmt.Errorf("could not create file in zip: %v", err)
+	}
+	switch {
+	case item.entry.Info.IsDir():
+		return nil
+	case item.entry.LinkTarget != "":
+		// Symlinks are stored with the link mode and the target as
+		// content, as done by Info-ZIP.
+		_, err = io.WriteString(zipFileWriter, item.entry.LinkTarget)
+		progress.Files++
+		return err
+	}
+	return copyFile(zipFileWriter, item.entry.FullPath, opts.Progress, progress)
+}
+
+// prepareFile compresses the file at path with method and encrypts it when
+// passphrase is set, in memory for small files and into a temporary file
+// in tempDir otherwise.
+func prepareFile(path string, size int64, method uint16, passphrase, tempDir string) preparedFile {
+	var prepared preparedFile
+	source, err := os.Open(path)
+	if err != nil {
+		prepared.err = fmt.Errorf("could not open file: %v", err)
+		return prepared
+	}
+	defer source.Close()
+
+	var dest io.Writer
+	if size > spoolMemoryLimit {
+		prepared.file, err = os.CreateTemp(tempDir, ".fenfa-deflate-*")
+		if err != nil {
+			prepared.err = fmt.Errorf("could not create temporary file: %v", err)
+			return prepared
+		}
+		dest = prepared.file
+	} else {
+		prepared.data = bytes.NewBuffer(make([]byte, 0, size))
+		dest = prepared.data
+	}
+
+	counter := &countingWriter{w: dest}
+	var closers []io.Closer
+	var content io.Writer = counter
+	if passphrase != "" {
+		encrypter, err := newAESEncryptWriter(content, passphrase)
+		if err != nil {
+			prepared.err = fmt.Errorf("could not encrypt file: %v", err)
+			return prepared
+		}
+		content = encrypter
+		closers = append(closers, encrypter)
+	}
+	if method == zip.Deflate {
+		flateWriter, _ := flate.NewWriter(content, deflateLevel)
+		content = flateWriter
+		closers = append(closers, flateWriter)
+	}
+
+	checksum := crc32.NewIEEE()
+	prepared.size, err = io.Copy(content, io.TeeReader(source, checksum))
+	// Close the compressor before the encrypter it writes to.
+	for i := len(closers) - 1; i >= 0 && err == nil; i-- {
+		err = closers[i].Close()
+	}
+	if err != nil {
+		prepared.err = fmt.Errorf("could not compress file: %v", err)
+		return prepared
+	}
+	prepared.crc32 = checksum.Sum32()
+	prepared.compressedSize = counter.n
+	return prepared
+}
+
+func (c preparedFile) reader() (io.Reader, error) {
+	if c.file == nil {
+		return c.data, nil
+	}
+	if _, err := c.file.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("could not read temporary file: %v", err)
+	}
+	return c.file, nil
+}
+
+func (c preparedFile) cleanup() {
+	if c.file != nil {
+		c.file.Close()
+		os.Remove(c.file.Name())
+	}
+}
+
+// discard drops an item that will not be written, removing the temporary
+// file of its prepared content.
+func (item zipItem) discard() {
+	if item.result != nil {
+		prepared := <-item.result
+		prepared.cleanup()
+	}
+}
+
+// prepareRawHeader sets the fields zip.Writer.CreateHeader fills in itself,
+// so files written with CreateRaw are encoded the same way, including the
+// data descriptor following the content.
+func prepareRawHeader(header *zip.FileHeader) {
+	if requiresUTF8(header.Name) {
+		header.Flags |= 0x800
+	}
+	header.CreatorVersion = header.CreatorVersion&0xff00 | 20
+	header.ReaderVersion = 20
+	if header.CompressedSize64 > math.MaxUint32 || header.UncompressedSize64 > math.MaxUint32 {
+		header.ReaderVersion = 45
+	}
+	header.Flags |= 0x8
+
+	if !header.Modified.IsZero() {
+		header.ModifiedDate, header.ModifiedTime = msDosTime(header.Modified)
+		// Extended timestamp extra field with the modification time.
+		var extra [9]byte
+		binary.LittleEndian.PutUint16(extra[0:], 0x5455)
+		binary.LittleEndian.PutUint16(extra[2:], 5)
+		extra[4] = 1
+		binary.LittleEndian.PutUint32(extra[5:], uint32(header.Modified.Unix()))
+		header.Extra = append(header.Extra, extra[:]...)
+	}
+}
+
+// requiresUTF8 reports whether a name needs the UTF-8 flag because it is
+// valid UTF-8 but not CP-437 compatible, as decided by archive/zip.
+func requiresUTF8(name string) bool {
+	if !utf8.ValidString(name) {
+		return false
+	}
+	for _, r := range name {
+		if r < 0x20 || r > 0x7d || r == 0x5c {
+			return true
+		}
+	}
+	return false
+}
+
+func msDosTime(t time.Time) (date uint16, clock uint16) {
+	date = uint16(t.Day() + int(t.Month())<<5 + (t.Year()-1980)<<9)
+	clock = uint16(t.Second()/2 + t.Minute()<<5 + t.Hour()<<11)
+	return date, clock
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
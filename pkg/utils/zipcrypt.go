@@ -0,0 +1,132 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"math/big"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// WinZip AES encryption (AE-2) with 256 bit keys, as read by 7-Zip, WinZip,
+// macOS Archive Utility and libarchive.
+const (
+	winZipAESMethod     = 99
+	winZipAESExtraID    = 0x9901
+	winZipAESVersion    = 2 // AE-2: the CRC is not stored
+	winZipAESStrength   = 3 // AES-256
+	winZipAESKeySize    = 32
+	winZipAESSaltSize   = 16
+	winZipAESIterations = 1000
+	winZipAESMACSize    = 10
+)
+
+// passphraseAlphabet leaves out characters that are easily confused when a
+// passphrase is read out or typed.
+const passphraseAlphabet = "abcdefghjkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// GeneratePassphrase returns a random passphrase for an encrypted archive,
+// in groups of five characters separated by dashes.
+func GeneratePassphrase() (string, error) {
+	const groups, groupSize = 5, 5
+	passphrase := make([]byte, 0, groups*(groupSize+1))
+	limit := big.NewInt(int64(len(passphraseAlphabet)))
+	for i := 0; i < groups*groupSize; i++ {
+		if i > 0 && i%groupSize == 0 {
+			passphrase = append(passphrase, '-')
+		}
+		n, err := rand.Int(rand.Reader, limit)
+		if err != nil {
+			return "", fmt.Errorf("could not generate passphrase: %w", err)
+		}
+		passphrase = append(passphrase, passphraseAlphabet[n.Int64()])
+	}
+	return string(passphrase), nil
+}
+
+// aesEncryptWriter encrypts the content of a zip entry. It writes the salt
+// and password verifier first, then the encrypted data, and the truncated
+// HMAC-SHA1 of the encrypted data on Close.
+type aesEncryptWriter struct {
+	w       io.Writer
+	block   cipher.Block
+	mac     hash.Hash
+	counter uint64
+	stream  [aes.BlockSize]byte
+	used    int // Bytes of stream already used
+	buf     []byte
+}
+
+func newAESEncryptWriter(w io.Writer, passphrase string) (*aesEncryptWriter, error) {
+	salt := make([]byte, winZipAESSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("could not generate salt: %w", err)
+	}
+	keys := pbkdf2.Key([]byte(passphrase), salt, winZipAESIterations, 2*winZipAESKeySize+2, sha1.New)
+	block, err := aes.NewCipher(keys[:winZipAESKeySize])
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(salt); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(keys[2*winZipAESKeySize:]); err != nil {
+		return nil, err
+	}
+	return &aesEncryptWriter{
+		w:     w,
+		block: block,
+		mac:   hmac.New(sha1.New, keys[winZipAESKeySize:2*winZipAESKeySize]),
+		used:  aes.BlockSize,
+	}, nil
+}
+
+// Write encrypts p with AES in CTR mode. Unlike cipher.NewCTR, WinZip
+// increments the counter as a little-endian number starting at 1.
+func (a *aesEncryptWriter) Write(p []byte) (int, error) {
+	if cap(a.buf) < len(p) {
+		a.buf = make([]byte, len(p))
+	}
+	out := a.buf[:len(p)]
+	for i := range p {
+		if a.used == aes.BlockSize {
+			a.counter++
+			var counterBlock [aes.BlockSize]byte
+			binary.LittleEndian.PutUint64(counterBlock[:], a.counter)
+			a.block.Encrypt(a.stream[:], counterBlock[:])
+			a.used = 0
+		}
+		out[i] = p[i] ^ a.stream[a.used]
+		a.used++
+	}
+	a.mac.Write(out)
+	return a.w.Write(out)
+}
+
+// Close writes the authentication code. It does not close the underlying
+// writer.
+func (a *aesEncryptWriter) Close() error {
+	_, err := a.w.Write(a.mac.Sum(nil)[:winZipAESMACSize])
+	return err
+}
+
+// winZipAESExtra returns the extra field describing an AES encrypted entry
+// whose content was compressed with method.
+func winZipAESExtra(method uint16) []byte {
+	extra := make([]byte, 11)
+	binary.LittleEndian.PutUint16(extra[0:], winZipAESExtraID)
+	binary.LittleEndian.PutUint16(extra[2:], 7)
+	binary.LittleEndian.PutUint16(extra[4:], winZipAESVersion)
+	copy(extra[6:], "AE")
+	extra[8] = winZipAESStrength
+	binary.LittleEndian.PutUint16(extra[9:], method)
+	return extra
+}
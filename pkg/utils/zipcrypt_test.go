@@ -0,0 +1,210 @@
+package utils
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// decryptWinZipAES reverses aesEncryptWriter, checking the password
+// verifier and the authentication code.
+func decryptWinZipAES(data []byte, passphrase string) ([]byte, error) {
+	if len(data) < winZipAESSaltSize+2+winZipAESMACSize {
+		return nil, errors.New("entry too short")
+	}
+	salt := data[:winZipAESSaltSize]
+	verifier := data[winZipAESSaltSize : winZipAESSaltSize+2]
+	ciphertext := data[winZipAESSaltSize+2 : len(data)-winZipAESMACSize]
+	code := data[len(data)-winZipAESMACSize:]
+
+	keys := pbkdf2.Key([]byte(passphrase), salt, winZipAESIterations, 2*winZipAESKeySize+2, sha1.New)
+	if !bytes.Equal(verifier, keys[2*winZipAESKeySize:]) {
+		return nil, errors.New("wrong passphrase")
+	}
+	mac := hmac.New(sha1.New, keys[winZipAESKeySize:2*winZipAESKeySize])
+	mac.Write(ciphertext)
+	if !hmac.Equal(code, mac.Sum(nil)[:winZipAESMACSize]) {
+		return nil, errors.New("authentication failed")
+	}
+
+	block, err := aes.NewCipher(keys[:winZipAESKeySize])
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, len(ciphertext))
+	var counterBlock, stream [aes.BlockSize]byte
+	for i := range ciphertext {
+		if i%aes.BlockSize == 0 {
+			binary.LittleEndian.PutUint64(counterBlock[:], uint64(i/aes.BlockSize+1))
+			block.Encrypt(stream[:], counterBlock[:])
+		}
+		plaintext[i] = ciphertext[i] ^ stream[i%aes.BlockSize]
+	}
+	return plaintext, nil
+}
+
+func TestAESEncryptWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		writes int // Number of writes the content is split into
+	}{
+		{"empty", 0, 1},
+		{"shorter than a block", 5, 1},
+		{"several blocks", 1000, 1},
+		{"uneven writes", 1000, 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := bytes.Repeat([]byte("fenfa"), tt.size/5)
+			var buf bytes.Buffer
+			w, err := newAESEncryptWriter(&buf, "correct horse")
+			if err != nil {
+				t.Fatal(err)
+			}
+			step := len(content)/tt.writes + 1
+			for rest := content; len(rest) > 0; {
+				n := min(step, len(rest))
+				if _, err := w.Write(rest[:n]); err != nil {
+					t.Fatal(err)
+				}
+				rest = rest[n:]
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := decryptWinZipAES(buf.Bytes(), "correct horse")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("decrypted %d bytes, want the %d written", len(got), len(content))
+			}
+			if _, err := decryptWinZipAES(buf.Bytes(), "wrong horse"); err == nil {
+				t.Error("decrypted with the wrong passphrase")
+			}
+			tampered := bytes.Clone(buf.Bytes())
+			tampered[len(tampered)/2] ^= 1
+			if _, err := decryptWinZipAES(tampered, "correct horse"); err == nil {
+				t.Error("decrypted tampered content")
+			}
+		})
+	}
+}
+
+func TestEncryptedZip(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"notes.txt":      bytes.Repeat([]byte("compressible "), 1000),
+		"photo.jpg":      []byte("already compressed"),
+		"sub/large.txt":  bytes.Repeat([]byte("spooled to a temporary file "), spoolMemoryLimit/20),
+		"sub/empty.conf": {},
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	opts := ArchiveOptions{Format: FormatZip, MaxDepth: -1, Symlinks: SymlinkSkip, Passphrase: "correct horse", Workers: 4, TempDir: t.TempDir()}
+	if err := WriteArchive(&buf, dir, opts); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := 0
+	for _, f := range reader.File {
+		want, ok := files[f.Name]
+		if !ok {
+			continue
+		}
+		found++
+		if f.Method != winZipAESMethod || f.Flags&0x1 == 0 {
+			t.Errorf("%s: method %d, flags %#x, want an encrypted entry", f.Name, f.Method, f.Flags)
+			continue
+		}
+		raw, err := f.OpenRaw()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := decryptWinZipAES(data, "correct horse")
+		if err != nil {
+			t.Errorf("%s: %v", f.Name, err)
+			continue
+		}
+		if method := binary.LittleEndian.Uint16(f.Extra[len(f.Extra)-2:]); method == zip.Deflate {
+			content, err = io.ReadAll(flate.NewReader(bytes.NewReader(content)))
+			if err != nil {
+				t.Errorf("%s: %v", f.Name, err)
+				continue
+			}
+		}
+		if !bytes.Equal(content, want) {
+			t.Errorf("%s: content differs after decryption", f.Name)
+		}
+	}
+	if found != len(files) {
+		t.Errorf("found %d of %d files in the archive", found, len(files))
+	}
+}
+
+func TestEncryptedZipRefusesSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("file.txt", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	opts := ArchiveOptions{Format: FormatZip, MaxDepth: -1, Symlinks: SymlinkPreserve, Passphrase: "correct horse"}
+	if err := WriteArchive(io.Discard, dir, opts); err == nil {
+		t.Error("preserved a symlink in an encrypted archive")
+	}
+}
+
+func TestGeneratePassphrase(t *testing.T) {
+	format := regexp.MustCompile(`^[` + passphraseAlphabet + `]{5}(-[` + passphraseAlphabet + `]{5}){4}$`)
+	seen := map[string]bool{}
+	for i := 0; i < 10; i++ {
+		passphrase, err := GeneratePassphrase()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !format.MatchString(passphrase) {
+			t.Errorf("passphrase %q does not match the expected format", passphrase)
+		}
+		if seen[passphrase] {
+			t.Errorf("passphrase %q generated twice", passphrase)
+		}
+		seen[passphrase] = true
+		if strings.ContainsAny(passphrase, "0O1lI") {
+			t.Errorf("passphrase %q holds easily confused characters", passphrase)
+		}
+	}
+}